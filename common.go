@@ -23,6 +23,15 @@ type Metadata interface {
 	String() string
 }
 
+// HTTPMetadata is implemented by Metadata that may carry the HTTP proxy
+// request a connection arrived with. Empty strings mean unknown.
+type HTTPMetadata interface {
+	UserAgent() string
+	HTTPHost() string
+	HTTPMethod() string
+	HTTPPath() string
+}
+
 type Rule interface {
 	RuleType() byte
 	Adapter() string
@@ -0,0 +1,208 @@
+package dns
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheSize   = 4096
+	DefaultMinTTL      = 60 * time.Second
+	DefaultNegativeTTL = 60 * time.Second
+
+	// An entry hit at least prefetchHits times is refreshed in the
+	// background once less than 1/prefetchRatio of its TTL is left.
+	prefetchHits  = 2
+	prefetchRatio = 10
+)
+
+// cache is a LRU of answers, each kept for its own TTL. Negative answers
+// are cached with their error.
+type cache struct {
+	sync.Mutex
+	size int
+	ll   *list.List
+	m    map[string]*list.Element
+}
+
+// Resolver is a cached answer.
+type Resolver struct {
+	host       string
+	ips        []net.IP
+	err        error
+	last       time.Time
+	expires    time.Time
+	hits       int
+	prefetched bool
+}
+
+// get returns a copy of the live entry for host, and whether the caller
+// should prefetch it, which is reported once per entry.
+func (c *cache) get(host string, now time.Time) (d Resolver, prefetch, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.m[host]
+	if !ok {
+		return
+	}
+	entry := e.Value.(*Resolver)
+	if !now.Before(entry.expires) {
+		c.remove(e)
+		return Resolver{}, false, false
+	}
+	c.ll.MoveToFront(e)
+	entry.hits++
+	if !entry.prefetched && entry.err == nil && entry.hits >= prefetchHits &&
+		entry.expires.Sub(now) < entry.expires.Sub(entry.last)/prefetchRatio {
+		entry.prefetched, prefetch = true, true
+	}
+	return *entry, prefetch, true
+}
+
+func (c *cache) set(host string, ips []net.IP, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	entry := &Resolver{host: host, ips: ips, err: err, last: now, expires: now.Add(ttl)}
+	c.Lock()
+	defer c.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]*list.Element)
+		c.ll = list.New()
+	}
+	if e, ok := c.m[host]; ok {
+		e.Value = entry
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.m[host] = c.ll.PushFront(entry)
+	size := c.size
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	for c.ll.Len() > size {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *cache) delete(host string) {
+	c.Lock()
+	if e, ok := c.m[host]; ok {
+		c.remove(e)
+	}
+	c.Unlock()
+}
+
+func (c *cache) remove(e *list.Element) {
+	c.ll.Remove(e)
+	delete(c.m, e.Value.(*Resolver).host)
+}
+
+// purge drops expired entries.
+func (c *cache) purge() {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	if c.ll == nil {
+		return
+	}
+	for e := c.ll.Back(); e != nil; {
+		prev := e.Prev()
+		if !now.Before(e.Value.(*Resolver).expires) {
+			c.remove(e)
+		}
+		e = prev
+	}
+}
+
+// call is a lookup in flight, which concurrent lookups of the same host
+// wait for instead of sending their own queries.
+type call struct {
+	wg  sync.WaitGroup
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// SetCacheTTL clamps the time answers are cached for to [min, max]. A zero
+// max leaves it unbounded.
+func (r *Server) SetCacheTTL(min, max time.Duration) {
+	r.Lock()
+	r.minTTL, r.maxTTL = min, max
+	r.Unlock()
+}
+
+// SetNegativeTTL sets how long NXDOMAIN and empty answers are cached for
+// at most, and when the upstream gives no SOA record to take it from.
+// Zero disables negative caching.
+func (r *Server) SetNegativeTTL(ttl time.Duration) {
+	r.Lock()
+	r.negativeTTL = ttl
+	r.Unlock()
+}
+
+// SetCacheSize bounds the number of cached answers.
+func (r *Server) SetCacheSize(size int) {
+	r.cache.Lock()
+	r.cache.size = size
+	r.cache.Unlock()
+}
+
+// cacheTTL returns how long an answer with the given record TTL is cached.
+func (r *Server) cacheTTL(ttl time.Duration, negative bool) time.Duration {
+	r.RLock()
+	defer r.RUnlock()
+	if negative {
+		if ttl <= 0 || ttl > r.negativeTTL {
+			return r.negativeTTL
+		}
+		return ttl
+	}
+	if ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	return ttl
+}
+
+// resolve looks host up, sharing the query with concurrent callers, and
+// caches the answer.
+func (r *Server) resolve(host string) ([]net.IP, time.Duration, error) {
+	r.Lock()
+	if r.inflight == nil {
+		r.inflight = make(map[string]*call)
+	}
+	if c, ok := r.inflight[host]; ok {
+		r.Unlock()
+		c.wg.Wait()
+		return c.ips, c.ttl, c.err
+	}
+	c := &call{}
+	c.wg.Add(1)
+	r.inflight[host] = c
+	r.Unlock()
+
+	ips, seconds, err := r.lookupHost(host, r.RetryTimes)
+	negative := isNegative(ips, err)
+	if err == nil || negative {
+		c.ttl = r.cacheTTL(time.Duration(seconds)*time.Second, negative)
+		r.cache.set(host, ips, err, c.ttl)
+	}
+	c.ips, c.err = ips, err
+
+	r.Lock()
+	delete(r.inflight, host)
+	r.Unlock()
+	c.wg.Done()
+	return c.ips, c.ttl, c.err
+}
+
+// prefetch refreshes a hot entry before it expires.
+func (r *Server) prefetch(host string) {
+	r.resolve(host)
+}
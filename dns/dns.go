@@ -11,18 +11,33 @@ import (
 	"github.com/miekg/dns"
 )
 
+// Preference selects which address families LookupHost asks for and in
+// which order they are returned. Both are queried in parallel.
+type Preference int
+
+const (
+	PreferIPv4 Preference = iota
+	PreferIPv6
+	IPv4Only
+	IPv6Only
+)
+
+var (
+	errNXDomain   = errors.New(dns.RcodeToString[dns.RcodeNameError])
+	errNoUpstream = errors.New("no dns upstream")
+)
+
 type Server struct {
 	sync.RWMutex
-	servers    []string
-	timeout    time.Duration
-	cache      map[string]*Resolver
-	RetryTimes int
-	r          *rand.Rand
-}
-
-type Resolver struct {
-	ips  []net.IP
-	last time.Time
+	upstreams   []Upstream
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	cache       cache
+	inflight    map[string]*call
+	RetryTimes  int
+	Preference  Preference
+	r           *rand.Rand
 }
 
 var current = &Server{}
@@ -31,11 +46,10 @@ func Background() *Server {
 	return current
 }
 
+// New returns a Server querying servers, which are addresses or URLs as
+// NewUpstream takes them, and caching answers for timeout at most.
 func New(servers []string, timeout time.Duration) *Server {
-	for i := range servers {
-		servers[i] = net.JoinHostPort(servers[i], "53")
-	}
-	return &Server{servers: servers, timeout: timeout, cache: make(map[string]*Resolver), RetryTimes: len(servers) * 2, r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	return &Server{upstreams: newUpstreams(servers), minTTL: DefaultMinTTL, maxTTL: timeout, negativeTTL: DefaultNegativeTTL, RetryTimes: len(servers) * 2, r: rand.New(rand.NewSource(time.Now().UnixNano()))}
 }
 
 func WithBackground(server *Server, timeout time.Duration) {
@@ -44,87 +58,216 @@ func WithBackground(server *Server, timeout time.Duration) {
 }
 
 func (r *Server) LookupHost(host string) (result []net.IP, err error) {
-	if result = r.Get(host); result != nil {
-		return
+	result, _, err = r.LookupHostTTL(host)
+	return
+}
+
+// LookupHostTTL is LookupHost that also returns how long the answer may
+// be cached: the record TTL within the cache clamps, or what is left of it
+// in the cache.
+func (r *Server) LookupHostTTL(host string) ([]net.IP, time.Duration, error) {
+	now := time.Now()
+	if d, prefetch, ok := r.cache.get(host, now); ok {
+		if prefetch {
+			go r.prefetch(host)
+		}
+		return d.ips, d.expires.Sub(now), d.err
 	}
-	if result, err = r.lookupHost(host, r.RetryTimes); err != nil {
-		return
+	return r.resolve(host)
+}
+
+func (r *Server) lookupHost(host string, triesLeft int) ([]net.IP, uint32, error) {
+	return Lookup(r.upstream, host, r.Preference, triesLeft)
+}
+
+// Lookup resolves host through the upstreams next picks, querying A and
+// AAAA in parallel as preference says and retrying timeouts up to retries
+// times. The TTL, in seconds, is the lowest of the answer, or the negative
+// caching one when there are no addresses.
+func Lookup(next func() (Upstream, error), host string, preference Preference, retries int) ([]net.IP, uint32, error) {
+	var qtypes []uint16
+	switch preference {
+	case IPv4Only:
+		qtypes = []uint16{dns.TypeA}
+	case IPv6Only:
+		qtypes = []uint16{dns.TypeAAAA}
+	case PreferIPv6:
+		qtypes = []uint16{dns.TypeAAAA, dns.TypeA}
+	default:
+		qtypes = []uint16{dns.TypeA, dns.TypeAAAA}
 	}
-	r.Set(host, result)
-	return
+
+	answers := make([]answer, len(qtypes))
+	var wg sync.WaitGroup
+	for i := range qtypes {
+		wg.Add(1)
+		go func(a *answer, qtype uint16) {
+			defer wg.Done()
+			a.ips, a.ttl, a.err = exchangeHost(next, host, qtype, retries)
+		}(&answers[i], qtypes[i])
+	}
+	wg.Wait()
+	return mergeAnswers(answers)
 }
 
-func (r *Server) lookupHost(host string, triesLeft int) ([]net.IP, error) {
+func exchangeHost(next func() (Upstream, error), host string, qtype uint16, triesLeft int) ([]net.IP, uint32, error) {
 	m1 := new(dns.Msg)
 	m1.Id = dns.Id()
 	m1.RecursionDesired = true
 	m1.Question = make([]dns.Question, 1)
-	m1.Question[0] = dns.Question{dns.Fqdn(host), dns.TypeA, dns.ClassINET}
-	in, err := dns.Exchange(m1, r.servers[r.r.Intn(len(r.servers))])
+	m1.Question[0] = dns.Question{dns.Fqdn(host), qtype, dns.ClassINET}
+	upstream, err := next()
+	if err != nil {
+		return nil, 0, err
+	}
+	in, err := upstream.Exchange(m1)
 
 	result := []net.IP{}
 
 	if err != nil {
 		if strings.HasSuffix(err.Error(), "i/o timeout") && triesLeft > 0 {
 			triesLeft--
-			return r.lookupHost(host, triesLeft)
+			return exchangeHost(next, host, qtype, triesLeft)
 		}
-		return result, err
+		return result, 0, err
 	}
 
+	if in != nil && in.Rcode == dns.RcodeNameError {
+		return result, negativeTTL(in), errNXDomain
+	}
 	if in != nil && in.Rcode != dns.RcodeSuccess {
-		return result, errors.New(dns.RcodeToString[in.Rcode])
+		return result, 0, errors.New(dns.RcodeToString[in.Rcode])
 	}
 
+	var ttl uint32
 	for _, record := range in.Answer {
-		if t, ok := record.(*dns.A); ok {
-			result = append(result, t.A)
+		var ip net.IP
+		switch t := record.(type) {
+		case *dns.A:
+			ip = t.A
+		case *dns.AAAA:
+			ip = t.AAAA
+		default:
+			continue
 		}
+		result = append(result, ip)
+		if len(result) == 1 || record.Header().Ttl < ttl {
+			ttl = record.Header().Ttl
+		}
+	}
+	if len(result) == 0 {
+		ttl = negativeTTL(in)
 	}
-	return result, err
+	return result, ttl, err
 }
 
-func (r *Server) Get(host string) []net.IP {
-	r.RLock()
-	defer r.RUnlock()
-
-	if d, ok := r.cache[host]; ok {
-		if time.Now().Sub(d.last) < r.timeout {
-			return d.ips
+// negativeTTL returns how long a negative answer may be cached, from the
+// SOA record of its authority section (RFC 2308 5), or 0 without one.
+func negativeTTL(in *dns.Msg) uint32 {
+	for _, record := range in.Ns {
+		if soa, ok := record.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
 		}
 	}
-
-	return nil
+	return 0
 }
 
-func (r *Server) Set(host string, ips []net.IP) {
-	if ips == nil || len(ips) == 0 {
-		return
-	}
+// isNegative reports whether a lookup found the host has no addresses, as
+// opposed to failing.
+func isNegative(ips []net.IP, err error) bool {
+	return err == errNXDomain || (err == nil && len(ips) == 0)
+}
 
+// AddUpstream adds an upstream to the ones queries are spread over.
+func (r *Server) AddUpstream(upstream Upstream) {
 	r.Lock()
-	r.cache[host] = &Resolver{ips: ips, last: time.Now()}
+	r.upstreams = append(r.upstreams, upstream)
 	r.Unlock()
 }
 
-func (r *Server) Remove(host string) {
+func (r *Server) upstream() (Upstream, error) {
 	r.Lock()
 	defer r.Unlock()
+	if len(r.upstreams) == 0 {
+		return nil, errNoUpstream
+	}
+	if r.r == nil {
+		r.r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return r.upstreams[r.r.Intn(len(r.upstreams))], nil
+}
+
+type answer struct {
+	ips []net.IP
+	ttl uint32
+	err error
+}
 
-	if _, ok := r.cache[host]; ok {
-		delete(r.cache, host)
+// mergeAnswers joins the answers in order. It fails if every query failed,
+// or if one failed and the others found no addresses, so that a transient
+// failure is not taken for a negative answer. The TTL is the lowest of the answers with addresses, or of
+// the negative ones when there are none.
+func mergeAnswers(answers []answer) ([]net.IP, uint32, error) {
+	result := []net.IP{}
+	var ttl uint32
+	var err error
+	failed := 0
+	for _, a := range answers {
+		if a.err != nil {
+			if err == nil {
+				err = a.err
+			}
+			failed++
+			continue
+		}
+		if len(a.ips) > 0 && (len(result) == 0 || a.ttl < ttl) {
+			ttl = a.ttl
+		}
+		result = append(result, a.ips...)
 	}
+	if failed == 0 || (failed < len(answers) && len(result) > 0) {
+		err = nil
+	}
+	if len(result) == 0 {
+		for i, a := range answers {
+			if i == 0 || a.ttl < ttl {
+				ttl = a.ttl
+			}
+		}
+	}
+	return result, ttl, err
 }
 
-func (r *Server) cleaner() {
-	if r != nil {
-		r.Lock()
-		r.cache = make(map[string]*Resolver, 1024)
-		r.Unlock()
+func (r *Server) Get(host string) []net.IP {
+	if d, prefetch, ok := r.cache.get(host, time.Now()); ok {
+		if prefetch {
+			go r.prefetch(host)
+		}
+		return d.ips
 	}
+	return nil
 }
 
-func (r *Server) dispatchLoop(timeout time.Duration) {
-	r.cleaner()
-	time.AfterFunc(timeout, func() { r.dispatchLoop(timeout) })
-}
\ No newline at end of file
+func (r *Server) Set(host string, ips []net.IP) {
+	if ips == nil || len(ips) == 0 {
+		return
+	}
+	r.RLock()
+	ttl := r.maxTTL
+	r.RUnlock()
+	r.cache.set(host, ips, nil, r.cacheTTL(ttl, false))
+}
+
+func (r *Server) Remove(host string) {
+	r.cache.delete(host)
+}
+
+// dispatchLoop drops expired answers every interval. Live ones stay, so
+// hosts do not all expire at once.
+func (r *Server) dispatchLoop(interval time.Duration) {
+	r.cache.purge()
+	time.AfterFunc(interval, func() { r.dispatchLoop(interval) })
+}
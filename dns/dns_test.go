@@ -0,0 +1,194 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startUpstream serves handler on a local UDP port and returns a Server
+// querying it.
+func startUpstream(t *testing.T, handler dns.HandlerFunc) *Server {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return New([]string{pc.LocalAddr().String()}, time.Hour)
+}
+
+// testHandler answers example.com with an A and an AAAA record with the
+// given TTL, and any other name with NXDOMAIN, counting the queries.
+func testHandler(queries *int32, ttl uint32, delay time.Duration) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		time.Sleep(delay)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		if !strings.HasPrefix(q.Name, "example.com") {
+			m.Rcode = dns.RcodeNameError
+			soa, _ := dns.NewRR(". 3600 IN SOA ns. host. 1 7200 900 1209600 5")
+			m.Ns = append(m.Ns, soa)
+			w.WriteMsg(m)
+			return
+		}
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestLookupHostDualStack(t *testing.T) {
+	var queries int32
+	r := startUpstream(t, testHandler(&queries, 300, 0))
+
+	ips, err := r.LookupHost("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || ips[0].String() != "192.0.2.1" || ips[1].String() != "2001:db8::1" {
+		t.Fatalf("LookupHost = %v", ips)
+	}
+
+	r.Preference = IPv6Only
+	r.Remove("example.com")
+	if ips, _ = r.LookupHost("example.com"); len(ips) != 1 || ips[0].String() != "2001:db8::1" {
+		t.Fatalf("IPv6Only LookupHost = %v", ips)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	var queries int32
+	r := startUpstream(t, testHandler(&queries, 300, 0))
+	r.SetCacheTTL(0, time.Minute)
+
+	if _, ttl, err := r.LookupHostTTL("example.com"); err != nil || ttl != time.Minute {
+		t.Fatalf("LookupHostTTL ttl = %v, %v", ttl, err)
+	}
+	if _, ttl, _ := r.LookupHostTTL("example.com"); ttl > time.Minute || ttl < 59*time.Second {
+		t.Fatalf("cached ttl = %v", ttl)
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Fatalf("%d queries, want 2", n)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	var queries int32
+	r := startUpstream(t, testHandler(&queries, 300, 0))
+
+	for i := 0; i < 3; i++ {
+		_, ttl, err := r.LookupHostTTL("nx.example.org")
+		if err != errNXDomain {
+			t.Fatalf("LookupHostTTL err = %v", err)
+		}
+		if ttl > 5*time.Second {
+			t.Fatalf("negative ttl = %v, want the SOA minimum", ttl)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Fatalf("%d queries, want 2", n)
+	}
+}
+
+func TestLookupHostSingleflight(t *testing.T) {
+	var queries int32
+	r := startUpstream(t, testHandler(&queries, 300, 100*time.Millisecond))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ips, err := r.LookupHost("example.com"); err != nil || len(ips) != 2 {
+				t.Errorf("LookupHost = %v, %v", ips, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Fatalf("%d queries, want 2", n)
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := &cache{size: 2}
+	ips := []net.IP{net.ParseIP("192.0.2.1")}
+	c.set("a", ips, nil, time.Minute)
+	c.set("b", ips, nil, time.Minute)
+	c.get("a", time.Now())
+	c.set("c", ips, nil, time.Minute)
+
+	if _, _, ok := c.get("b", time.Now()); ok {
+		t.Error("b should have been evicted")
+	}
+	for _, host := range []string{"a", "c"} {
+		if _, _, ok := c.get(host, time.Now()); !ok {
+			t.Errorf("%v should be cached", host)
+		}
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	c := &cache{}
+	c.set("a", []net.IP{net.ParseIP("192.0.2.1")}, nil, time.Second)
+	now := c.m["a"].Value.(*Resolver).last
+
+	if _, prefetch, _ := c.get("a", now); prefetch {
+		t.Error("should not prefetch a fresh entry")
+	}
+	if _, prefetch, _ := c.get("a", now.Add(950*time.Millisecond)); !prefetch {
+		t.Error("should prefetch a hot entry about to expire")
+	}
+	if _, prefetch, _ := c.get("a", now.Add(960*time.Millisecond)); prefetch {
+		t.Error("should prefetch only once")
+	}
+	if _, _, ok := c.get("a", now.Add(time.Second)); ok {
+		t.Error("entry should have expired")
+	}
+}
+
+func TestMergeAnswers(t *testing.T) {
+	answers := []answer{
+		{ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: 300},
+		{ips: []net.IP{net.ParseIP("2001:db8::1")}, ttl: 60},
+	}
+	result, ttl, err := mergeAnswers(answers)
+	if err != nil || len(result) != 2 || result[0].String() != "192.0.2.1" || ttl != 60 {
+		t.Error("mergeAnswers:", result, ttl, err)
+	}
+
+	answers[1] = answer{err: errors.New("SERVFAIL")}
+	result, ttl, err = mergeAnswers(answers)
+	if err != nil || len(result) != 1 || ttl != 300 {
+		t.Error("One failed query should not fail the lookup:", result, ttl, err)
+	}
+
+	answers[0] = answer{ttl: 60}
+	if result, _, err = mergeAnswers(answers); err == nil || len(result) != 0 {
+		t.Error("A failed query and an empty one should fail the lookup:", result, err)
+	}
+	if isNegative(result, err) {
+		t.Error("A failed query and an empty one should not be cached as negative")
+	}
+
+	answers[0] = answer{err: errors.New("NXDOMAIN")}
+	if _, _, err = mergeAnswers(answers); err == nil || err.Error() != "NXDOMAIN" {
+		t.Error("mergeAnswers should return the first error:", err)
+	}
+}
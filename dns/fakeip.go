@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// fakeIPTTL is the TTL of fake answers, in seconds, short so that clients
+// come back once the proxy is gone.
+const fakeIPTTL = 1
+
+// FakeIPPool hands out addresses of an IPv4 range, such as 198.18.0.0/15,
+// as answers for domains, so that a transparent proxy can tell the domain
+// a connection is for from its destination. Each domain keeps its address
+// until the pool runs out, when the least recently used one is recycled.
+type FakeIPPool struct {
+	sync.Mutex
+	network *net.IPNet
+	base    uint32
+	size    uint32
+	next    uint32
+	ll      *list.List
+	hosts   map[string]*list.Element
+	ips     map[uint32]*list.Element
+}
+
+type fakeIP struct {
+	host   string
+	offset uint32
+}
+
+// NewFakeIPPool returns a pool of the addresses of cidr, but for the
+// network and broadcast ones.
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fake ip range %v %v", cidr, err.Error())
+	}
+	ones, bits := network.Mask.Size()
+	if bits != 8*net.IPv4len || bits-ones < 2 {
+		return nil, fmt.Errorf("invalid fake ip range %v", cidr)
+	}
+	return &FakeIPPool{
+		network: network,
+		base:    binary.BigEndian.Uint32(network.IP.To4()),
+		size:    uint32(1)<<uint(bits-ones) - 2,
+		ll:      list.New(),
+		hosts:   make(map[string]*list.Element),
+		ips:     make(map[uint32]*list.Element),
+	}, nil
+}
+
+func (p *FakeIPPool) ip(offset uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, p.base+1+offset)
+	return ip
+}
+
+func (p *FakeIPPool) offset(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !p.network.Contains(ip4) {
+		return 0, false
+	}
+	offset := binary.BigEndian.Uint32(ip4) - p.base - 1
+	return offset, offset < p.size
+}
+
+// Lookup returns the address of host, allocating one if it has none.
+func (p *FakeIPPool) Lookup(host string) net.IP {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	p.Lock()
+	defer p.Unlock()
+	if e, ok := p.hosts[host]; ok {
+		p.ll.MoveToFront(e)
+		return p.ip(e.Value.(*fakeIP).offset)
+	}
+	return p.ip(p.put(host, p.alloc()))
+}
+
+// alloc returns a free offset, recycling the least recently used one when
+// there is none left.
+func (p *FakeIPPool) alloc() uint32 {
+	if uint32(p.ll.Len()) < p.size {
+		for {
+			offset := p.next
+			p.next = (p.next + 1) % p.size
+			if _, ok := p.ips[offset]; !ok {
+				return offset
+			}
+		}
+	}
+	e := p.ll.Back()
+	entry := e.Value.(*fakeIP)
+	p.ll.Remove(e)
+	delete(p.hosts, entry.host)
+	delete(p.ips, entry.offset)
+	return entry.offset
+}
+
+func (p *FakeIPPool) put(host string, offset uint32) uint32 {
+	e := p.ll.PushFront(&fakeIP{host: host, offset: offset})
+	p.hosts[host] = e
+	p.ips[offset] = e
+	return offset
+}
+
+// LookupIP returns the domain ip was handed out for.
+func (p *FakeIPPool) LookupIP(ip net.IP) (string, bool) {
+	offset, ok := p.offset(ip)
+	if !ok {
+		return "", false
+	}
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.ips[offset]
+	if !ok {
+		return "", false
+	}
+	p.ll.MoveToFront(e)
+	return e.Value.(*fakeIP).host, true
+}
+
+// Contains reports whether ip is one the pool can hand out, which leaves
+// out the network and broadcast addresses of its range.
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	_, ok := p.offset(ip)
+	return ok
+}
+
+// Save writes the mapping to name, one "ip host" line per domain from the
+// least recently used, so that clients keep valid answers over restarts.
+func (p *FakeIPPool) Save(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to save fake ip pool %v", err.Error())
+	}
+	w := bufio.NewWriter(f)
+	p.Lock()
+	for e := p.ll.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*fakeIP)
+		fmt.Fprintf(w, "%v %v\n", p.ip(entry.offset), entry.host)
+	}
+	p.Unlock()
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to save fake ip pool %v", err.Error())
+	}
+	return f.Close()
+}
+
+// Load restores a mapping written by Save. Entries outside the range of
+// the pool are skipped.
+func (p *FakeIPPool) Load(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to load fake ip pool %v", err.Error())
+	}
+	defer f.Close()
+	p.Lock()
+	defer p.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		offset, ok := p.offset(net.ParseIP(fields[0]))
+		if !ok {
+			continue
+		}
+		if e, ok := p.ips[offset]; ok {
+			p.ll.Remove(e)
+			delete(p.hosts, e.Value.(*fakeIP).host)
+		}
+		if e, ok := p.hosts[fields[1]]; ok {
+			p.ll.Remove(e)
+			delete(p.ips, e.Value.(*fakeIP).offset)
+		}
+		p.put(fields[1], offset)
+		if offset >= p.next {
+			p.next = (offset + 1) % p.size
+		}
+	}
+	return scanner.Err()
+}
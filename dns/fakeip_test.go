@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/koomox/goproxy/tunnel"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.Lookup("www.example.com")
+	if a.String() != "198.18.0.1" {
+		t.Errorf("first address = %v", a)
+	}
+	if b := p.Lookup("WWW.example.com."); !b.Equal(a) {
+		t.Errorf("same domain got %v and %v", a, b)
+	}
+	if b := p.Lookup("example.org"); b.Equal(a) || !p.Contains(b) {
+		t.Errorf("example.org got %v", b)
+	}
+	if host, ok := p.LookupIP(a); !ok || host != "www.example.com" {
+		t.Errorf("LookupIP(%v) = %v, %v", a, host, ok)
+	}
+	if _, ok := p.LookupIP(net.ParseIP("198.18.200.1")); ok {
+		t.Error("unallocated address should not reverse")
+	}
+	if _, ok := p.LookupIP(net.ParseIP("192.0.2.1")); ok {
+		t.Error("address out of range should not reverse")
+	}
+	for _, s := range []string{"198.18.0.0", "198.19.255.255", "192.0.2.1"} {
+		if p.Contains(net.ParseIP(s)) {
+			t.Errorf("Contains(%v) should be false", s)
+		}
+	}
+	if !p.Contains(net.ParseIP("198.19.255.254")) {
+		t.Error("Contains should accept the last usable address")
+	}
+
+	for _, cidr := range []string{"2001:db8::/64", "198.18.0.0/31", "bad"} {
+		if _, err := NewFakeIPPool(cidr); err == nil {
+			t.Errorf("NewFakeIPPool(%v) should fail", cidr)
+		}
+	}
+}
+
+func TestFakeIPPoolRecycle(t *testing.T) {
+	// Two usable addresses: .1 and .2.
+	p, _ := NewFakeIPPool("198.18.0.0/30")
+	a := p.Lookup("a.example")
+	b := p.Lookup("b.example")
+	p.LookupIP(a)
+	if c := p.Lookup("c.example"); !c.Equal(b) {
+		t.Errorf("c.example got %v, want the least recently used %v", c, b)
+	}
+	if host, _ := p.LookupIP(b); host != "c.example" {
+		t.Errorf("%v reverses to %v, want c.example", b, host)
+	}
+	if host, ok := p.LookupIP(a); !ok || host != "a.example" {
+		t.Errorf("a.example lost its address: %v %v", host, ok)
+	}
+}
+
+func TestFakeIPPoolSaveLoad(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "fakeip.txt")
+	p, _ := NewFakeIPPool("198.18.0.0/15")
+	a := p.Lookup("a.example")
+	b := p.Lookup("b.example")
+	if err := p.Save(name); err != nil {
+		t.Fatal(err)
+	}
+
+	q, _ := NewFakeIPPool("198.18.0.0/15")
+	if err := q.Load(name); err != nil {
+		t.Fatal(err)
+	}
+	if ip := q.Lookup("a.example"); !ip.Equal(a) {
+		t.Errorf("a.example = %v after load, want %v", ip, a)
+	}
+	if host, ok := q.LookupIP(b); !ok || host != "b.example" {
+		t.Errorf("LookupIP(%v) = %v after load", b, host)
+	}
+	if ip := q.Lookup("c.example"); ip.Equal(a) || ip.Equal(b) {
+		t.Errorf("c.example reused %v", ip)
+	}
+}
+
+func TestReverseFakeIP(t *testing.T) {
+	p, _ := NewFakeIPPool("198.18.0.0/15")
+	ip := p.Lookup("www.example.com")
+
+	addr, _ := tunnel.ResolveAddr("tcp", net.JoinHostPort(ip.String(), "443"))
+	m := &tunnel.Metadata{Command: tunnel.Connect, Address: addr}
+	if !m.ReverseFakeIP(p) {
+		t.Fatal("fake ip was not reversed")
+	}
+	if m.AddrType() != tunnel.DomainName || m.String() != "www.example.com:443" {
+		t.Errorf("reversed to %v", m)
+	}
+
+	addr, _ = tunnel.ResolveAddr("tcp", "192.0.2.1:443")
+	if m = (&tunnel.Metadata{Command: tunnel.Connect, Address: addr}); m.ReverseFakeIP(p) {
+		t.Errorf("real address reversed to %v", m)
+	}
+}
+
+func TestForwarderFakeIP(t *testing.T) {
+	var queries int32
+	f := NewForwarder(startUpstream(t, fixedHandler(&queries, "192.0.2.20")))
+	p, _ := NewFakeIPPool("198.18.0.0/15")
+	f.SetFakeIP(p)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	m, err := f.answer(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP(answerIP(m))
+	if host, ok := p.LookupIP(ip); !ok || host != "www.example.com" {
+		t.Errorf("answered %v, which reverses to %v", ip, host)
+	}
+	req.SetQuestion("www.example.com.", dns.TypeAAAA)
+	if m, _ = f.answer(req); len(m.Answer) != 0 {
+		t.Errorf("AAAA answered %v", m.Answer)
+	}
+	if queries != 0 {
+		t.Errorf("%d upstream queries in fake ip mode", queries)
+	}
+}
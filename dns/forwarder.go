@@ -0,0 +1,231 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koomox/goproxy"
+	"github.com/miekg/dns"
+)
+
+// hostsTTL is the TTL of answers made from hosts entries, in seconds.
+const hostsTTL = 60
+
+// Forwarder is a DNS server for clients of the proxy. A and AAAA queries
+// are answered from hosts entries, or from the cache of the upstream group
+// the rules pick for the domain; other queries are passed to that group.
+type Forwarder struct {
+	sync.RWMutex
+	match  goproxy.Match
+	groups map[string]*Server
+	group  *Server
+	fakeIP *FakeIPPool
+	pc     net.PacketConn
+	l      net.Listener
+}
+
+// NewForwarder returns a Forwarder sending queries to group unless a rule
+// picks another one.
+func NewForwarder(group *Server) *Forwarder {
+	return &Forwarder{group: group, groups: make(map[string]*Server)}
+}
+
+// domainMatch is implemented by rules.Filter. Upstream groups are picked
+// by domain rules only, as IP rules would resolve the name being queried.
+type domainMatch interface {
+	MatchDomain(goproxy.Metadata) goproxy.Rule
+}
+
+// SetMatch sets the rules hosts entries and upstream groups are taken
+// from, usually a rules.Filter. Without a MatchDomain method, every query
+// goes to the default group.
+func (f *Forwarder) SetMatch(match goproxy.Match) {
+	f.Lock()
+	f.match = match
+	f.Unlock()
+}
+
+// AddGroup sends the queries for domains whose rule has adapter to group,
+// such as domestic domains with rule DIRECT to the local DNS.
+func (f *Forwarder) AddGroup(adapter string, group *Server) {
+	f.Lock()
+	f.groups[adapter] = group
+	f.Unlock()
+}
+
+// SetFakeIP answers A queries with addresses of pool instead of real ones,
+// and AAAA queries with none, but for hosts entries. Inbounds given pool
+// too, such as with socks.Server.SetFakeIP, match and dial connections to
+// those addresses by domain.
+func (f *Forwarder) SetFakeIP(pool *FakeIPPool) {
+	f.Lock()
+	f.fakeIP = pool
+	f.Unlock()
+}
+
+// queryName is a queried domain, as goproxy.Metadata for the rules.
+type queryName string
+
+func (q queryName) AddrType() byte {
+	return goproxy.AddrTypeDomainName
+}
+
+func (q queryName) Port() string {
+	return "53"
+}
+
+func (q queryName) Host() string {
+	return string(q)
+}
+
+func (q queryName) String() string {
+	return net.JoinHostPort(string(q), "53")
+}
+
+// route returns the hosts entry of host, if any, its upstream group and
+// the fake IP pool.
+func (f *Forwarder) route(host string) (string, *Server, *FakeIPPool) {
+	f.RLock()
+	defer f.RUnlock()
+	if f.match == nil {
+		return "", f.group, f.fakeIP
+	}
+	addr := f.match.MatchHosts(host)
+	if dm, ok := f.match.(domainMatch); ok {
+		if r := dm.MatchDomain(queryName(host)); r != nil {
+			if group, ok := f.groups[r.Adapter()]; ok {
+				return addr, group, f.fakeIP
+			}
+		}
+	}
+	return addr, f.group, f.fakeIP
+}
+
+func (f *Forwarder) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m, err := f.answer(req)
+	if err != nil {
+		m = new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		m.Truncate(size)
+	}
+	w.WriteMsg(m)
+}
+
+func (f *Forwarder) answer(req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return new(dns.Msg).SetRcodeFormatError(req), nil
+	}
+	q := req.Question[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	addr, group, pool := f.route(name)
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		upstream, err := group.upstream()
+		if err != nil {
+			return nil, err
+		}
+		in, err := upstream.Exchange(req)
+		if err != nil {
+			return nil, err
+		}
+		in.Id = req.Id
+		return in, nil
+	}
+
+	host := name
+	if addr != "" {
+		if ip := net.ParseIP(addr); ip != nil {
+			return answerIPs(req, []net.IP{ip}, hostsTTL), nil
+		}
+		host = addr
+	}
+	if pool != nil {
+		// Connections come back to the queried name, which the rules see
+		// before any hosts rewrite.
+		if q.Qtype == dns.TypeAAAA {
+			return answerIPs(req, nil, fakeIPTTL), nil
+		}
+		return answerIPs(req, []net.IP{pool.Lookup(name)}, fakeIPTTL), nil
+	}
+	ips, ttl, err := group.LookupHostTTL(host)
+	if err == errNXDomain {
+		return new(dns.Msg).SetRcode(req, dns.RcodeNameError), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seconds := uint32(ttl / time.Second)
+	if seconds == 0 {
+		seconds = 1
+	}
+	return answerIPs(req, ips, seconds), nil
+}
+
+// answerIPs answers req with the addresses of the queried family.
+func answerIPs(req *dns.Msg, ips []net.IP, ttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+	for _, ip := range ips {
+		switch ip4 := ip.To4(); {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip4 == nil:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return m
+}
+
+// ListenAndServe serves DNS on addr over both UDP and TCP.
+func (f *Forwarder) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	return f.Serve(pc, l)
+}
+
+// Serve answers queries arriving on pc and l until one of them fails or
+// the Forwarder is closed.
+func (f *Forwarder) Serve(pc net.PacketConn, l net.Listener) error {
+	f.Lock()
+	f.pc, f.l = pc, l
+	f.Unlock()
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- (&dns.Server{PacketConn: pc, Handler: f}).ActivateAndServe()
+	}()
+	go func() {
+		errChan <- (&dns.Server{Listener: l, Handler: f}).ActivateAndServe()
+	}()
+	err := <-errChan
+	f.Close()
+	return err
+}
+
+func (f *Forwarder) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.pc != nil {
+		f.pc.Close()
+	}
+	if f.l != nil {
+		f.l.Close()
+	}
+	return nil
+}
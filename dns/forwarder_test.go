@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/koomox/goproxy/rules"
+)
+
+// fixedHandler answers every A query with ip, counting the queries.
+func fixedHandler(queries *int32, ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		if q.Qtype == dns.TypeA {
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(ip)})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func exchange(t *testing.T, network, addr, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	c := &dns.Client{Net: network, Timeout: time.Second}
+	in, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+func answerIP(in *dns.Msg) string {
+	for _, rr := range in.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String()
+		}
+	}
+	return ""
+}
+
+func TestForwarder(t *testing.T) {
+	var localQueries, remoteQueries int32
+	local := startUpstream(t, fixedHandler(&localQueries, "192.0.2.10"))
+	remote := startUpstream(t, fixedHandler(&remoteQueries, "192.0.2.20"))
+
+	filter := rules.New([]byte("DOMAIN-SUFFIX,cn,DIRECT\nFINAL,PROXY"))
+	filter.SetHosts("10.0.0.1", "router.lan")
+	f := NewForwarder(remote)
+	f.AddGroup(rules.ActionDirect, local)
+	f.SetMatch(filter)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.Serve(pc, l)
+	defer f.Close()
+	addr := pc.LocalAddr().String()
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"www.example.cn", "192.0.2.10"},
+		{"www.example.com", "192.0.2.20"},
+		{"router.lan", "10.0.0.1"},
+		{"www.example.com", "192.0.2.20"},
+	}
+	for _, tt := range tests {
+		if got := answerIP(exchange(t, "udp", addr, tt.name, dns.TypeA)); got != tt.want {
+			t.Errorf("%v = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := answerIP(exchange(t, "tcp", l.Addr().String(), "www.example.cn", dns.TypeA)); got != "192.0.2.10" {
+		t.Errorf("over tcp www.example.cn = %v", got)
+	}
+	if in := exchange(t, "udp", addr, "router.lan", dns.TypeAAAA); in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 {
+		t.Errorf("AAAA of an IPv4 hosts entry = %v", in)
+	}
+
+	// The example.com and example.cn lookups above were each answered from
+	// the cache after the first one, so each took an A and an AAAA query.
+	if n := atomic.LoadInt32(&localQueries); n != 2 {
+		t.Errorf("%d local queries, want 2", n)
+	}
+	if n := atomic.LoadInt32(&remoteQueries); n != 2 {
+		t.Errorf("%d remote queries, want 2", n)
+	}
+
+	if in := exchange(t, "udp", addr, "example.com", dns.TypeTXT); in.Rcode != dns.RcodeSuccess {
+		t.Errorf("TXT was not forwarded: %v", in)
+	}
+	if n := atomic.LoadInt32(&remoteQueries); n != 3 {
+		t.Errorf("%d remote queries after TXT, want 3", n)
+	}
+}
+
+type countingResolver int32
+
+func (r *countingResolver) LookupHost(host string) ([]net.IP, error) {
+	atomic.AddInt32((*int32)(r), 1)
+	return []net.IP{net.ParseIP("10.0.0.1")}, nil
+}
+
+func TestForwarderDomainRulesOnly(t *testing.T) {
+	var localQueries, remoteQueries int32
+	local := startUpstream(t, fixedHandler(&localQueries, "192.0.2.10"))
+	remote := startUpstream(t, fixedHandler(&remoteQueries, "192.0.2.20"))
+
+	var lookups countingResolver
+	for _, ordered := range []bool{false, true} {
+		filter := rules.New([]byte("IP-CIDR,10.0.0.0/8,DIRECT\nDOMAIN-SUFFIX,cn,DIRECT\nFINAL,PROXY"))
+		filter.SetOrdered(ordered)
+		filter.SetResolver(&lookups, time.Minute)
+		f := NewForwarder(remote)
+		f.AddGroup(rules.ActionDirect, local)
+		f.SetMatch(filter)
+
+		for name, want := range map[string]*Server{"www.example.cn": local, "www.example.com": remote} {
+			if _, group, _ := f.route(name); group != want {
+				t.Errorf("ordered %v: %v went to the wrong group", ordered, name)
+			}
+		}
+	}
+	if n := atomic.LoadInt32((*int32)(&lookups)); n != 0 {
+		t.Errorf("%d lookups through the rules resolver, want 0", n)
+	}
+}
@@ -0,0 +1,279 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	upstreamTimeout = 5 * time.Second
+	maxIdleConns    = 4
+
+	dohMediaType = "application/dns-message"
+	dohTemplate  = "{?dns}"
+)
+
+// Upstream sends queries to a DNS server.
+type Upstream interface {
+	Exchange(m *dns.Msg) (*dns.Msg, error)
+	Address() string
+}
+
+// NewUpstream returns the upstream for a server address, selected by its
+// scheme:
+//
+//	8.8.8.8:53, udp://8.8.8.8          plain DNS over UDP
+//	tls://1.1.1.1, tls://dns.google:853 DNS over TLS (RFC 7858)
+//	https://dns.example/dns-query       DNS over HTTPS (RFC 8484), POST
+//	https://dns.example/dns-query{?dns} DNS over HTTPS, GET
+//
+// config is the TLS configuration of encrypted upstreams; nil uses the
+// system roots.
+func NewUpstream(address string, config *tls.Config) (Upstream, error) {
+	if !strings.Contains(address, "://") {
+		return &plainUpstream{addr: withPort(address, "53")}, nil
+	}
+	u, err := url.Parse(strings.Replace(address, dohTemplate, "", 1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns upstream %v %v", address, err.Error())
+	}
+	switch u.Scheme {
+	case "udp":
+		return &plainUpstream{addr: withPort(u.Host, "53")}, nil
+	case "tls":
+		if config == nil {
+			config = &tls.Config{}
+		} else {
+			config = config.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		return &tlsUpstream{addr: withPort(u.Host, "853"), config: config}, nil
+	case "https":
+		transport := &http.Transport{
+			TLSClientConfig:     config,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: maxIdleConns,
+			IdleConnTimeout:     90 * time.Second,
+		}
+		return &httpsUpstream{
+			url:    u.String(),
+			get:    strings.Contains(address, dohTemplate),
+			client: &http.Client{Transport: transport, Timeout: upstreamTimeout},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported dns upstream %v", address)
+	}
+}
+
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// newUpstreams builds the upstreams of servers. A server that cannot be
+// used fails its queries instead.
+func newUpstreams(servers []string) []Upstream {
+	upstreams := make([]Upstream, 0, len(servers))
+	for _, server := range servers {
+		u, err := NewUpstream(server, nil)
+		if err != nil {
+			u = &errUpstream{addr: server, err: err}
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams
+}
+
+type plainUpstream struct {
+	addr string
+}
+
+// Exchange retries over TCP when the UDP answer is truncated.
+func (u *plainUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	in, err := dns.Exchange(m, u.addr)
+	if err != nil || !in.Truncated {
+		return in, err
+	}
+	in, _, err = (&dns.Client{Net: "tcp", Timeout: upstreamTimeout}).Exchange(m, u.addr)
+	return in, err
+}
+
+func (u *plainUpstream) Address() string {
+	return u.addr
+}
+
+// tlsUpstream keeps a few idle connections around, as RFC 7858 suggests,
+// so most queries skip the handshake.
+type tlsUpstream struct {
+	sync.Mutex
+	addr   string
+	config *tls.Config
+	idle   []*dns.Conn
+}
+
+func (u *tlsUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	conn, reused, err := u.conn()
+	if err != nil {
+		return nil, err
+	}
+	in, err := u.exchange(conn, m)
+	if err != nil && reused {
+		// The server may have closed an idle connection.
+		if conn, err = u.dial(); err != nil {
+			return nil, err
+		}
+		in, err = u.exchange(conn, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.put(conn)
+	return in, nil
+}
+
+func (u *tlsUpstream) exchange(conn *dns.Conn, m *dns.Msg) (*dns.Msg, error) {
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if err := conn.WriteMsg(m); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	in, err := conn.ReadMsg()
+	if err == nil && in.Id != m.Id {
+		err = dns.ErrId
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return in, nil
+}
+
+func (u *tlsUpstream) conn() (*dns.Conn, bool, error) {
+	u.Lock()
+	if n := len(u.idle); n > 0 {
+		conn := u.idle[n-1]
+		u.idle = u.idle[:n-1]
+		u.Unlock()
+		return conn, true, nil
+	}
+	u.Unlock()
+	conn, err := u.dial()
+	return conn, false, err
+}
+
+func (u *tlsUpstream) dial() (*dns.Conn, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: upstreamTimeout}, "tcp", u.addr, u.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial dns over tls %v %v", u.addr, err.Error())
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+func (u *tlsUpstream) put(conn *dns.Conn) {
+	u.Lock()
+	defer u.Unlock()
+	if len(u.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	u.idle = append(u.idle, conn)
+}
+
+func (u *tlsUpstream) Address() string {
+	return "tls://" + u.addr
+}
+
+// httpsUpstream reuses connections through the keep-alive and HTTP/2
+// support of its http.Client.
+type httpsUpstream struct {
+	url    string
+	get    bool
+	client *http.Client
+}
+
+func (u *httpsUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	// The ID is 0 on the wire so that HTTP caches can share answers.
+	q := m.Copy()
+	q.Id = 0
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if u.get {
+		sep := "?"
+		if strings.Contains(u.url, "?") {
+			sep = "&"
+		}
+		req, err = http.NewRequest(http.MethodGet, u.url+sep+"dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, u.url, bytes.NewReader(b))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns over https %v status %v", u.url, resp.Status)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != dohMediaType {
+		return nil, fmt.Errorf("dns over https %v content type %v", u.url, ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	in := new(dns.Msg)
+	if err = in.Unpack(body); err != nil {
+		return nil, err
+	}
+	in.Id = m.Id
+	return in, nil
+}
+
+func (u *httpsUpstream) Address() string {
+	if u.get {
+		return u.url + dohTemplate
+	}
+	return u.url
+}
+
+type errUpstream struct {
+	addr string
+	err  error
+}
+
+func (u *errUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return nil, u.err
+}
+
+func (u *errUpstream) Address() string {
+	return u.addr
+}
@@ -0,0 +1,212 @@
+package dns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func answerA(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	hdr := dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}
+	m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")})
+	return m
+}
+
+func query() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	return m
+}
+
+func checkAnswer(t *testing.T, u Upstream, m *dns.Msg) {
+	in, err := u.Exchange(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Id != m.Id || len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("%v answered %v", u.Address(), in)
+	}
+}
+
+// newDoH returns a DNS over HTTPS stand-in, counting its connections.
+func newDoH(t *testing.T, conns *int32) *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			b, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			b, err = io.ReadAll(r.Body)
+		}
+		req := new(dns.Msg)
+		if err != nil || req.Unpack(b) != nil || req.Id != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		resp, _ := answerA(req).Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(resp)
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func testTLSConfig(ts *httptest.Server) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	return &tls.Config{RootCAs: pool}
+}
+
+func TestDoH(t *testing.T) {
+	var conns int32
+	ts := newDoH(t, &conns)
+	for _, address := range []string{ts.URL + "/dns-query", ts.URL + "/dns-query{?dns}"} {
+		u, err := NewUpstream(address, testTLSConfig(ts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			checkAnswer(t, u, query())
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Fatalf("%d connections for two upstreams, want 2", n)
+	}
+}
+
+func TestDoHMediaTypeParams(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		req.Unpack(b)
+		resp, _ := answerA(req).Pack()
+		w.Header().Set("Content-Type", "Application/DNS-Message; charset=binary")
+		w.Write(resp)
+	}))
+	defer ts.Close()
+	u, err := NewUpstream(ts.URL+"/dns-query", testTLSConfig(ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAnswer(t, u, query())
+}
+
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+func TestDoT(t *testing.T) {
+	// Borrow the certificate of an httptest server, valid for 127.0.0.1.
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: l}
+	srv := &dns.Server{Listener: cl, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(answerA(req))
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	u, err := NewUpstream("tls://"+l.Addr().String(), testTLSConfig(ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		checkAnswer(t, u, query())
+	}
+	if n := atomic.LoadInt32(&cl.accepted); n != 1 {
+		t.Fatalf("%d connections, want 1", n)
+	}
+}
+
+func TestPlainTruncated(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skip(err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Truncated = true
+		w.WriteMsg(m)
+	})}
+	tcp := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(answerA(req))
+	})}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	defer udp.Shutdown()
+	defer tcp.Shutdown()
+
+	u, err := NewUpstream(pc.LocalAddr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAnswer(t, u, query())
+}
+
+func TestNewUpstream(t *testing.T) {
+	for address, want := range map[string]string{
+		"8.8.8.8":                       "8.8.8.8:53",
+		"udp://8.8.8.8:5353":            "8.8.8.8:5353",
+		"2001:4860:4860::8888":          "[2001:4860:4860::8888]:53",
+		"tls://1.1.1.1":                 "tls://1.1.1.1:853",
+		"https://dns.example/dns-query": "https://dns.example/dns-query",
+	} {
+		u, err := NewUpstream(address, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Address() != want {
+			t.Errorf("NewUpstream(%v) = %v, want %v", address, u.Address(), want)
+		}
+	}
+	if _, err := NewUpstream("quic://dns.example", nil); err == nil {
+		t.Error("NewUpstream should reject unknown schemes")
+	}
+
+	r := New([]string{"quic://dns.example"}, time.Minute)
+	if _, err := r.LookupHost("example.com"); err == nil {
+		t.Error("LookupHost should fail through an unusable upstream")
+	}
+}
@@ -8,25 +8,44 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	proxydns "github.com/koomox/goproxy/dns"
 	"github.com/miekg/dns"
 )
 
+// Preference selects which address families LookupHost asks for and in
+// which order they are returned. Both are queried in parallel.
+type Preference = proxydns.Preference
+
+const (
+	PreferIPv4 = proxydns.PreferIPv4
+	PreferIPv6 = proxydns.PreferIPv6
+	IPv4Only   = proxydns.IPv4Only
+	IPv6Only   = proxydns.IPv6Only
+)
+
 // DnsResolver represents a dns resolver
 type DnsResolver struct {
 	Servers    []string
 	RetryTimes int
+	Preference Preference
 	r          *rand.Rand
+	mu         sync.Mutex
+	upstreams  map[string]proxydns.Upstream
 }
 
-// New initializes DnsResolver.
+// New initializes DnsResolver. Servers may also be tls:// and https://
+// URLs for DNS over TLS and DNS over HTTPS.
 func New(servers []string) *DnsResolver {
 	for i := range servers {
-		servers[i] = net.JoinHostPort(servers[i], "53")
+		if !strings.Contains(servers[i], "://") {
+			servers[i] = net.JoinHostPort(servers[i], "53")
+		}
 	}
 
-	return &DnsResolver{servers, len(servers) * 2, rand.New(rand.NewSource(time.Now().UnixNano()))}
+	return &DnsResolver{Servers: servers, RetryTimes: len(servers) * 2, r: rand.New(rand.NewSource(time.Now().UnixNano()))}
 }
 
 // NewFromResolvConf initializes DnsResolver from resolv.conf like file.
@@ -39,41 +58,46 @@ func NewFromResolvConf(path string) (*DnsResolver, error) {
 	for _, ipAddress := range config.Servers {
 		servers = append(servers, net.JoinHostPort(ipAddress, "53"))
 	}
-	return &DnsResolver{servers, len(servers) * 2, rand.New(rand.NewSource(time.Now().UnixNano()))}, err
+	return &DnsResolver{Servers: servers, RetryTimes: len(servers) * 2, r: rand.New(rand.NewSource(time.Now().UnixNano()))}, err
 }
 
 // LookupHost returns IP addresses of provied host.
 // In case of timeout retries query RetryTimes times.
 func (r *DnsResolver) LookupHost(host string) ([]net.IP, error) {
-	return r.lookupHost(host, r.RetryTimes)
+	result, _, err := r.lookupHost(host, r.RetryTimes)
+	return result, err
 }
 
-func (r *DnsResolver) lookupHost(host string, triesLeft int) ([]net.IP, error) {
-	m1 := new(dns.Msg)
-	m1.Id = dns.Id()
-	m1.RecursionDesired = true
-	m1.Question = make([]dns.Question, 1)
-	m1.Question[0] = dns.Question{dns.Fqdn(host), dns.TypeA, dns.ClassINET}
-	in, err := dns.Exchange(m1, r.Servers[r.r.Intn(len(r.Servers))])
+// LookupHostTTL is LookupHost that also returns the lowest TTL of the
+// answer.
+func (r *DnsResolver) LookupHostTTL(host string) ([]net.IP, time.Duration, error) {
+	result, ttl, err := r.lookupHost(host, r.RetryTimes)
+	return result, time.Duration(ttl) * time.Second, err
+}
 
-	result := []net.IP{}
+func (r *DnsResolver) lookupHost(host string, triesLeft int) ([]net.IP, uint32, error) {
+	return proxydns.Lookup(r.upstream, host, r.Preference, triesLeft)
+}
 
-	if err != nil {
-		if strings.HasSuffix(err.Error(), "i/o timeout") && triesLeft > 0 {
-			triesLeft--
-			return r.lookupHost(host, triesLeft)
-		}
-		return result, err
+// upstream picks a server, and keeps its upstream so that encrypted ones
+// reuse their connections.
+func (r *DnsResolver) upstream() (proxydns.Upstream, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Servers) == 0 {
+		return nil, errors.New("no dns server")
 	}
-
-	if in != nil && in.Rcode != dns.RcodeSuccess {
-		return result, errors.New(dns.RcodeToString[in.Rcode])
+	server := r.Servers[r.r.Intn(len(r.Servers))]
+	if u, ok := r.upstreams[server]; ok {
+		return u, nil
 	}
-
-	for _, record := range in.Answer {
-		if t, ok := record.(*dns.A); ok {
-			result = append(result, t.A)
-		}
+	u, err := proxydns.NewUpstream(server, nil)
+	if err != nil {
+		return nil, err
 	}
-	return result, err
+	if r.upstreams == nil {
+		r.upstreams = make(map[string]proxydns.Upstream)
+	}
+	r.upstreams[server] = u
+	return u, nil
 }
@@ -1,15 +1,26 @@
 package freedom
 
 import (
+	"context"
 	"fmt"
 	"github.com/koomox/goproxy/tunnel"
 	"net"
+	"sync"
 	"time"
 )
 
 type PacketConn struct {
 	deadline time.Duration
 	*net.UDPConn
+
+	dialer   *Dialer
+	mu       sync.Mutex
+	resolved map[string]resolvedIP
+}
+
+type resolvedIP struct {
+	ip      net.IP
+	expires time.Time
 }
 
 type Conn struct {
@@ -50,7 +61,7 @@ func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 		}
 		return c.WriteToUDP(p, udpAddr)
 	}
-	ip, err := addr.(*tunnel.Address).ResolveIP()
+	ip, err := c.resolve(addr.(*tunnel.Address))
 	if err != nil {
 		return 0, err
 	}
@@ -64,12 +75,51 @@ func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 	return c.WriteToUDP(p, udpAddr)
 }
 
-func DialPacket(deadline time.Duration) (tunnel.PacketConn, error) {
+// resolve returns the IP of a. Each domain is resolved once per TTL for
+// the socket rather than once per datagram.
+func (c *PacketConn) resolve(a *tunnel.Address) (net.IP, error) {
+	if a.AddressType != tunnel.DomainName || a.IP != nil {
+		return a.ResolveIP()
+	}
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.resolved[a.DomainName]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.ip, nil
+	}
+	r, _ := c.dialer.config()
+	ips, ttl, err := lookupIPTTL(context.Background(), r, a.DomainName)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.resolved == nil {
+		c.resolved = make(map[string]resolvedIP)
+	}
+	for host, e := range c.resolved {
+		if !now.Before(e.expires) {
+			delete(c.resolved, host)
+		}
+	}
+	c.resolved[a.DomainName] = resolvedIP{ip: ips[0], expires: now.Add(ttl)}
+	c.mu.Unlock()
+	return ips[0], nil
+}
+
+// DialPacket returns a UDP socket that resolves domain destinations with
+// the resolver of d.
+func (d *Dialer) DialPacket(deadline time.Duration) (tunnel.PacketConn, error) {
 	conn, err := net.ListenPacket("udp", "")
 	if err != nil {
 		return nil, fmt.Errorf("freedom failed to listen udp socket %v", err.Error())
 	}
-	return &PacketConn{UDPConn: conn.(*net.UDPConn), deadline: deadline}, nil
+	return &PacketConn{UDPConn: conn.(*net.UDPConn), deadline: deadline, dialer: d}, nil
+}
+
+// DialPacket is Dialer.DialPacket with the default settings.
+func DialPacket(deadline time.Duration) (tunnel.PacketConn, error) {
+	return new(Dialer).DialPacket(deadline)
 }
 
 func (c *Conn) Close() error {
@@ -90,10 +140,17 @@ func (c *Conn) Write(b []byte) (int, error) {
 	return c.Conn.Write(b)
 }
 
-func DialConn(network, address string, timeout, deadline time.Duration) (*Conn, error) {
-	conn, err := net.DialTimeout(network, address, timeout)
+// DialConn connects to address, racing its addresses as Happy Eyeballs
+// does.
+func (d *Dialer) DialConn(network, address string, timeout, deadline time.Duration) (*Conn, error) {
+	conn, err := d.dialHappyEyeballs(network, address, timeout)
 	if err != nil {
 		return nil, err
 	}
 	return &Conn{Conn: conn, deadline: deadline}, nil
 }
+
+// DialConn is Dialer.DialConn with the default settings.
+func DialConn(network, address string, timeout, deadline time.Duration) (*Conn, error) {
+	return new(Dialer).DialConn(network, address, timeout, deadline)
+}
@@ -0,0 +1,243 @@
+package freedom
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultFallbackDelay is the Connection Attempt Delay of RFC 8305: how
+	// long an attempt is given before the next address is tried alongside
+	// it.
+	DefaultFallbackDelay = 250 * time.Millisecond
+
+	// DefaultResolveTTL is how long a PacketConn keeps the address of a
+	// domain when the resolver does not tell.
+	DefaultResolveTTL = time.Minute
+)
+
+// Resolver resolves the domains direct connections are made to.
+// dns.Server and dns_resolver.DnsResolver satisfy it.
+type Resolver interface {
+	LookupHost(host string) ([]net.IP, error)
+}
+
+// TTLResolver is a Resolver that also reports how long an answer may be
+// kept.
+type TTLResolver interface {
+	Resolver
+	LookupHostTTL(host string) ([]net.IP, time.Duration, error)
+}
+
+// Dialer makes direct connections. The zero value uses the system resolver
+// and DefaultFallbackDelay.
+type Dialer struct {
+	sync.RWMutex
+	resolver      Resolver
+	fallbackDelay time.Duration
+}
+
+// NewDialer returns a Dialer with the default settings.
+func NewDialer() *Dialer {
+	return &Dialer{fallbackDelay: DefaultFallbackDelay}
+}
+
+// SetResolver sets the resolver used by DialConn and PacketConn. The
+// system resolver is used when it is nil.
+func (d *Dialer) SetResolver(r Resolver) {
+	d.Lock()
+	d.resolver = r
+	d.Unlock()
+}
+
+// SetFallbackDelay sets how long DialConn waits for a connection attempt
+// before racing the next address against it.
+func (d *Dialer) SetFallbackDelay(delay time.Duration) {
+	d.Lock()
+	d.fallbackDelay = delay
+	d.Unlock()
+}
+
+func (d *Dialer) config() (Resolver, time.Duration) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.fallbackDelay == 0 {
+		return d.resolver, DefaultFallbackDelay
+	}
+	return d.resolver, d.fallbackDelay
+}
+
+// lookupIP returns the addresses of host, which may be an IP, in the order
+// of the resolver.
+func lookupIP(ctx context.Context, r Resolver, host string) ([]net.IP, error) {
+	ips, _, err := lookupIPTTL(ctx, r, host)
+	return ips, err
+}
+
+// lookupIPTTL is lookupIP that also returns how long the answer may be
+// kept, DefaultResolveTTL unless r is a TTLResolver.
+func lookupIPTTL(ctx context.Context, r Resolver, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, DefaultResolveTTL, nil
+	}
+	if r != nil {
+		// Resolver has no context, so give up on it rather than outlive ctx.
+		type result struct {
+			ips []net.IP
+			ttl time.Duration
+			err error
+		}
+		ch := make(chan result, 1)
+		go func() {
+			res := result{ttl: DefaultResolveTTL}
+			if tr, ok := r.(TTLResolver); ok {
+				res.ips, res.ttl, res.err = tr.LookupHostTTL(host)
+			} else {
+				res.ips, res.err = r.LookupHost(host)
+			}
+			ch <- res
+		}()
+		select {
+		case res := <-ch:
+			if res.err == nil && len(res.ips) == 0 {
+				res.err = fmt.Errorf("no such host %v", host)
+			}
+			return res.ips, res.ttl, res.err
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i := range addrs {
+		ips[i] = addrs[i].IP
+	}
+	return ips, DefaultResolveTTL, nil
+}
+
+// sortAddrs keeps the addresses usable on network and interleaves the two
+// families, starting with the family of the first address (RFC 8305 4).
+func sortAddrs(network string, ips []net.IP) []net.IP {
+	var first, second []net.IP
+	for _, ip := range ips {
+		v4 := ip.To4() != nil
+		if (v4 && strings.HasSuffix(network, "6")) || (!v4 && strings.HasSuffix(network, "4")) {
+			continue
+		}
+		if len(first) == 0 || (first[0].To4() != nil) == v4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	result := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			result = append(result, first[i])
+		}
+		if i < len(second) {
+			result = append(result, second[i])
+		}
+	}
+	return result
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dialParallel races connections to ips as Happy Eyeballs does. An attempt
+// starts every delay, or as soon as the previous one fails, and the first
+// to connect wins; the others are cancelled or closed.
+func dialParallel(ctx context.Context, dial dialFunc, network string, ips []net.IP, port string, delay time.Duration) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address to dial on %v", network)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	attempt := func() {
+		address := net.JoinHostPort(ips[next].String(), port)
+		go func() {
+			conn, err := dial(ctx, network, address)
+			results <- result{conn, err}
+		}()
+		next++
+		pending++
+	}
+
+	attempt()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	restart := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go func(n int) {
+					for ; n > 0; n-- {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(ips) {
+				attempt()
+				restart()
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				attempt()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+func (d *Dialer) dialHappyEyeballs(network, address string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	r, delay := d.config()
+	ips, err := lookupIP(ctx, r, host)
+	if err != nil {
+		return nil, fmt.Errorf("freedom failed to resolve %v %v", host, err.Error())
+	}
+	var nd net.Dialer
+	return dialParallel(ctx, nd.DialContext, network, sortAddrs(network, ips), port, delay)
+}
@@ -0,0 +1,170 @@
+package freedom
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/koomox/goproxy/tunnel"
+)
+
+func TestSortAddrs(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("2001:db8::3"),
+		net.ParseIP("192.0.2.1"),
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "2001:db8::3"}
+	got := sortAddrs("tcp", ips)
+	if len(got) != len(want) {
+		t.Fatalf("sortAddrs = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("sortAddrs = %v, want %v", got, want)
+		}
+	}
+	if got := sortAddrs("tcp4", ips); len(got) != 1 || got[0].String() != "192.0.2.1" {
+		t.Fatalf("sortAddrs tcp4 = %v", got)
+	}
+}
+
+func TestDialParallel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// The first address black holes, the second is refused, the third works.
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(address)
+		switch host {
+		case "2001:db8::1":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case "192.0.2.1":
+			return nil, errors.New("connection refused")
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+	}
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1"), net.ParseIP("127.0.0.1")}
+
+	start := time.Now()
+	conn, err := dialParallel(context.Background(), dial, "tcp", ips, port, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dialParallel took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err = dialParallel(ctx, dial, "tcp", ips[:2], port, 50*time.Millisecond); err == nil {
+		t.Fatal("dialParallel should fail without a reachable address")
+	}
+}
+
+type staticResolver []net.IP
+
+func (r staticResolver) LookupHost(host string) ([]net.IP, error) {
+	return r, nil
+}
+
+func TestDialConnResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	d := NewDialer()
+	d.SetResolver(staticResolver{net.ParseIP("127.0.0.1")})
+	conn, err := d.DialConn("tcp", net.JoinHostPort("example.com", port), time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+type blockingResolver chan struct{}
+
+func (r blockingResolver) LookupHost(host string) ([]net.IP, error) {
+	<-r
+	return nil, errors.New("unblocked")
+}
+
+func TestLookupIPContext(t *testing.T) {
+	r := make(blockingResolver)
+	defer close(r)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := lookupIP(ctx, r, "example.com"); err != context.DeadlineExceeded {
+		t.Fatalf("lookupIP = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// countingResolver answers with ip for ttl, counting its lookups.
+type countingResolver struct {
+	ip      net.IP
+	ttl     time.Duration
+	lookups int32
+}
+
+func (r *countingResolver) LookupHost(host string) ([]net.IP, error) {
+	ips, _, err := r.LookupHostTTL(host)
+	return ips, err
+}
+
+func (r *countingResolver) LookupHostTTL(host string) ([]net.IP, time.Duration, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	return []net.IP{r.ip}, r.ttl, nil
+}
+
+func TestPacketConnResolveTTL(t *testing.T) {
+	remote, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	r := &countingResolver{ip: net.ParseIP("127.0.0.1"), ttl: 200 * time.Millisecond}
+	d := NewDialer()
+	d.SetResolver(r)
+
+	pc, err := d.DialPacket(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	write := func() {
+		addr, _ := tunnel.ResolveAddr("udp", net.JoinHostPort("example.com", strconv.Itoa(remote.LocalAddr().(*net.UDPAddr).Port)))
+		if _, err := pc.WriteWithMetadata([]byte("ping"), &tunnel.Metadata{Address: addr}); err != nil {
+			t.Fatal(err)
+		}
+		remote.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := remote.ReadFrom(make([]byte, 16)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		write()
+	}
+	if n := atomic.LoadInt32(&r.lookups); n != 1 {
+		t.Errorf("%d lookups for one destination, want 1", n)
+	}
+	time.Sleep(2 * r.ttl)
+	write()
+	if n := atomic.LoadInt32(&r.lookups); n != 2 {
+		t.Errorf("%d lookups once the answer expired, want 2", n)
+	}
+}
@@ -6,12 +6,12 @@ require (
 	github.com/koomox/redblacktree v0.0.0-20210330113247-f46882cd075c
 	github.com/miekg/dns v1.1.50
 	github.com/oschwald/geoip2-golang v1.7.0
+	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985
 )
 
 require (
 	github.com/oschwald/maxminddb-golang v1.9.0 // indirect
 	golang.org/x/mod v0.4.2 // indirect
-	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985 // indirect
 	golang.org/x/sys v0.0.0-20220325203850-36772127a21f // indirect
 	golang.org/x/tools v0.1.6-0.20210726203631-07bc1bf47fb2 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
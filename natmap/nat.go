@@ -59,7 +59,7 @@ func (m *Natmap) Add(peer net.Addr, dst, src net.PacketConn, role byte) {
 
 // copy from src to dst at target with read timeout
 func (m *Natmap) timedCopy(dst net.PacketConn, target net.Addr, src net.PacketConn, timeout time.Duration, role byte) error {
-	buf := make([]byte, udpBufSize)
+	buf := make([]byte, socks.UdpBufSize)
 
 	for {
 		src.SetReadDeadline(time.Now().Add(timeout))
@@ -71,14 +71,22 @@ func (m *Natmap) timedCopy(dst net.PacketConn, target net.Addr, src net.PacketCo
 		switch role {
 		case RemoteServer: // server -> client: add original packet source
 			srcAddr := socks.ParseAddr(raddr.String())
-			copy(buf[len(srcAddr):], buf[:n])
-			copy(buf, srcAddr)
-			_, err = dst.WriteTo(buf[:len(srcAddr)+n], target)
+			if srcAddr == nil {
+				continue
+			}
+			_, err = dst.WriteTo(append(srcAddr, buf[:n]...), target)
 		case RelayClient: // client -> user: strip original packet source
 			srcAddr := socks.SplitAddr(buf[:n])
+			if srcAddr == nil {
+				continue
+			}
 			_, err = dst.WriteTo(buf[len(srcAddr):n], target)
 		case SocksClient: // client -> socks5 program: just set RSV and FRAG = 0
-			_, err = dst.WriteTo(append([]byte{0, 0, 0}, buf[:n]...), target)
+			srcAddr := socks.SplitAddr(buf[:n])
+			if srcAddr == nil {
+				continue
+			}
+			_, err = dst.WriteTo(socks.MakeUDPDatagram(srcAddr, buf[len(srcAddr):n]), target)
 		}
 
 		if err != nil {
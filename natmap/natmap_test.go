@@ -0,0 +1,188 @@
+package natmap
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/koomox/goproxy/socks"
+	"github.com/koomox/goproxy/trojan"
+)
+
+func listenPacket(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func readPacket(t *testing.T, pc net.PacketConn) []byte {
+	t.Helper()
+	buf := make([]byte, socks.UdpBufSize)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestNatmapRoles(t *testing.T) {
+	payload := []byte("hello natmap")
+	target := socks.ParseAddr("1.2.3.4:53")
+
+	tests := []struct {
+		name   string
+		role   byte
+		input  func(sender []byte) []byte
+		expect func(sender []byte) []byte
+	}{
+		{
+			name:   "RemoteServer",
+			role:   RemoteServer,
+			input:  func([]byte) []byte { return payload },
+			expect: func(sender []byte) []byte { return append(append([]byte{}, sender...), payload...) },
+		},
+		{
+			name:   "RelayClient",
+			role:   RelayClient,
+			input:  func([]byte) []byte { return append(append([]byte{}, target...), payload...) },
+			expect: func([]byte) []byte { return payload },
+		},
+		{
+			name:   "SocksClient",
+			role:   SocksClient,
+			input:  func([]byte) []byte { return append(append([]byte{}, target...), payload...) },
+			expect: func([]byte) []byte { return socks.MakeUDPDatagram(target, payload) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer, dst, src, sender := listenPacket(t), listenPacket(t), listenPacket(t), listenPacket(t)
+			m := NewNATmap(time.Second)
+			m.Add(peer.LocalAddr(), dst, src, tt.role)
+
+			senderAddr := socks.ParseAddr(sender.LocalAddr().String())
+			if _, err := sender.WriteTo(tt.input(senderAddr), src.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := readPacket(t, peer), tt.expect(senderAddr); !bytes.Equal(got, want) {
+				t.Errorf("got %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestTcpNatmapRoles(t *testing.T) {
+	payloads := [][]byte{[]byte("first"), []byte("second packet")}
+
+	tests := []struct {
+		name   string
+		role   byte
+		expect func(addr, payload []byte) []byte
+	}{
+		{
+			name:   "RemoteServer",
+			role:   RemoteServer,
+			expect: func(addr, payload []byte) []byte { return payload },
+		},
+		{
+			name:   "RelayClient",
+			role:   RelayClient,
+			expect: func(addr, payload []byte) []byte { return append(append([]byte{}, addr...), payload...) },
+		},
+		{
+			name:   "SocksClient",
+			role:   SocksClient,
+			expect: func(addr, payload []byte) []byte { return socks.MakeUDPDatagram(addr, payload) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer, dst := listenPacket(t), listenPacket(t)
+			// RemoteServer delivers to the packet destination, the others to the peer.
+			addr := socks.ParseAddr("1.2.3.4:53")
+			if tt.role == RemoteServer {
+				addr = socks.ParseAddr(peer.LocalAddr().String())
+			}
+			local, remote := net.Pipe()
+			defer remote.Close()
+			m := NewTcpNatmap(time.Second)
+			m.Add(peer.LocalAddr(), dst, local, tt.role)
+
+			// Two packets in one write, the second split across writes.
+			stream := append(trojan.MakeUDPacket(addr, payloads[0]), trojan.MakeUDPacket(addr, payloads[1])...)
+			go func() {
+				remote.Write(stream[:len(stream)-4])
+				remote.Write(stream[len(stream)-4:])
+			}()
+			for _, p := range payloads {
+				if got, want := readPacket(t, peer), tt.expect(addr, p); !bytes.Equal(got, want) {
+					t.Errorf("got %x, want %x", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUdpNatmapRoles(t *testing.T) {
+	payload := []byte("hello trojan")
+	target := socks.ParseAddr("1.2.3.4:53")
+
+	tests := []struct {
+		name       string
+		role       byte
+		input      []byte
+		expectAddr func(sender []byte) []byte
+	}{
+		{
+			name:       "RemoteServer",
+			role:       RemoteServer,
+			input:      payload,
+			expectAddr: func(sender []byte) []byte { return sender },
+		},
+		{
+			name:       "RelayClient",
+			role:       RelayClient,
+			input:      append(append([]byte{}, target...), payload...),
+			expectAddr: func([]byte) []byte { return target },
+		},
+		{
+			name:       "SocksClient",
+			role:       SocksClient,
+			input:      socks.MakeUDPDatagram(target, payload),
+			expectAddr: func([]byte) []byte { return target },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, sender := listenPacket(t), listenPacket(t)
+			local, remote := net.Pipe()
+			defer remote.Close()
+			m := NewUdpNatmap(time.Second)
+			m.Add(sender.LocalAddr(), local, src, tt.role)
+
+			if _, err := sender.WriteTo(tt.input, src.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			remote.SetReadDeadline(time.Now().Add(time.Second))
+			addr, got, _, err := trojan.ReadUDPacket(nil, remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.expectAddr(socks.ParseAddr(sender.LocalAddr().String())); !bytes.Equal(addr, want) {
+				t.Errorf("addr got %x, want %x", addr, want)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("payload got %x, want %x", got, payload)
+			}
+		})
+	}
+}
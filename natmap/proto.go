@@ -2,8 +2,6 @@ package natmap
 
 const (
 	RemoteServer byte = 1
-	RelayClient byte = 2
-	SocksClient byte = 4
+	RelayClient  byte = 2
+	SocksClient  byte = 4
 )
-
-const udpBufSize = 64 * 1024
@@ -3,10 +3,10 @@ package natmap
 import (
 	"github.com/koomox/goproxy/socks"
 	"github.com/koomox/goproxy/trojan"
+	"github.com/koomox/goproxy/tunnel"
 	"net"
 	"sync"
 	"time"
-	"errors"
 )
 
 // Packet NAT table
@@ -62,45 +62,42 @@ func (m *TcpNatmap) Add(peer net.Addr, dst net.PacketConn, src net.Conn, role by
 // copy from src to dst at target with read timeout
 func (m *TcpNatmap) timedCopy(dst net.PacketConn, target net.Addr, src net.Conn, timeout time.Duration, role byte) error {
 	var (
-		buf      []byte
-		buffer   []byte
 		addr     []byte
 		payload  []byte
 		buffered []byte
-		err      error
 	)
-	buf = make([]byte, socks.UdpBufSize)
+	buf := make([]byte, socks.UdpBufSize)
 	for {
-		if buffered == nil {
+		buffer := buffered
+		if buffer == nil {
 			src.SetReadDeadline(time.Now().Add(timeout))
 			n, err := src.Read(buf)
 			if err != nil {
 				return err
 			}
 			buffer = buf[:n]
-		} else {
-			buffer = buffered
-			buffered = nil
 		}
-		addr, payload, buffered, err = trojan.ReadUDPacket(buffer, src)
-		if addr == nil || payload == nil {
-			return errors.New("parse failed")
-		}
-		if err != nil {
+		var err error
+		if addr, payload, buffered, err = trojan.ReadUDPacket(buffer, src); err != nil {
 			return err
 		}
 
 		switch role {
-		case RemoteServer: // server -> client: add original packet source
-			srcAddr := socks.ParseAddr(target.String())
-			copy(buf[len(srcAddr):], buf)
-			copy(buf, srcAddr)
-			_, err = dst.WriteTo(buf[:len(srcAddr)], target)
-		case RelayClient: // client -> user: strip original packet source
+		case RemoteServer: // client -> target: send payload to the packet destination
+			var address *tunnel.Address
+			if address, err = tunnel.SplitAddr(addr); err != nil {
+				return err
+			}
+			address.NetworkType = "udp"
+			var raddr *net.UDPAddr
+			if raddr, err = net.ResolveUDPAddr("udp", address.String()); err != nil {
+				continue
+			}
+			_, err = dst.WriteTo(payload, raddr)
+		case RelayClient: // client -> user: keep original packet source
 			_, err = dst.WriteTo(append(addr, payload...), target)
 		case SocksClient: // client -> socks5 program: just set RSV and FRAG = 0
-			b := append([]byte{0, 0, 0}, addr...)
-			_, err = dst.WriteTo(append(b, payload...), target)
+			_, err = dst.WriteTo(socks.MakeUDPDatagram(addr, payload), target)
 		}
 
 		if err != nil {
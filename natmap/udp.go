@@ -60,7 +60,7 @@ func (m *UdpNatmap) Add(peer net.Addr, dst net.Conn, src net.PacketConn, role by
 
 // copy from src to dst at target with read timeout
 func (m *UdpNatmap) timedCopy(dst net.Conn, target net.Addr, src net.PacketConn, timeout time.Duration, role byte) error {
-	buf := make([]byte, udpBufSize)
+	buf := make([]byte, socks.UdpBufSize)
 
 	for {
 		src.SetReadDeadline(time.Now().Add(timeout))
@@ -72,12 +72,22 @@ func (m *UdpNatmap) timedCopy(dst net.Conn, target net.Addr, src net.PacketConn,
 		switch role {
 		case RemoteServer: // server -> client: add original packet source
 			srcAddr := socks.ParseAddr(raddr.String())
+			if srcAddr == nil {
+				continue
+			}
 			_, err = dst.Write(trojan.MakeUDPacket(srcAddr, buf[:n]))
-		case RelayClient: // client -> user: strip original packet source
-			srcAddr := socks.SplitAddr(buf[:n])
-			_, err = dst.Write(trojan.MakeUDPacket(srcAddr, buf[:n]))
-		case SocksClient: // client -> socks5 program: just set RSV and FRAG = 0
-			_, err = dst.Write(buf[:n])
+		case RelayClient: // user -> server: frame packet with its destination
+			dstAddr := socks.SplitAddr(buf[:n])
+			if dstAddr == nil {
+				continue
+			}
+			_, err = dst.Write(trojan.MakeUDPacket(dstAddr, buf[len(dstAddr):n]))
+		case SocksClient: // socks5 program -> server: strip RSV and FRAG
+			frag, dstAddr, payload, splitErr := socks.SplitUDPDatagram(buf[:n])
+			if splitErr != nil || frag != 0 {
+				continue
+			}
+			_, err = dst.Write(trojan.MakeUDPacket(dstAddr, payload))
 		}
 
 		if err != nil {
@@ -29,6 +29,7 @@ const (
 	RuleTypePort           byte = 0x09
 	RuleTypeFinal          byte = 0x0A
 	RuleTypeMATCH          byte = 0x0B
+	RuleTypeIPCIDR6        byte = 0x0C
 )
 
 type Filter struct {
@@ -38,28 +39,31 @@ type Filter struct {
 
 	geoDB *geoip2.Reader // GeoIP
 
-	bypassDomains      []interface{}
-	systemBypass       []string
-	ruleHosts          []*RuleHost // local hosts
-	rulePort           *redblacktree.Tree
-	ruleDomains        *redblacktree.Tree
-	ruleSuffixDomains  *redblacktree.Tree
-	ruleKeywordDomains []*Rule
-	ruleUserAgent      []*Rule
-	ruleIPCIDR         []*RuleIPCIDR
-	ruleGeoIP          []*Rule
-	ruleFinal          *Rule
+	bypassDomains []interface{}
+	systemBypass  []string
+	ruleHosts     []*RuleHost // local hosts
+	rulePort      *redblacktree.Tree
+	ruleFinal     *Rule
+
+	ordered      bool
+	publicSuffix bool
+	ruleList     ruleList
+	resolver     *resolveCache
 }
 
 type Rule struct {
-	ruleType byte
-	word     string
-	adapter  string
+	ruleType  byte
+	word      string
+	adapter   string
+	index     int
+	noResolve bool
 }
 
 type RuleIPCIDR struct {
-	cidr    *net.IPNet
-	adapter string
+	cidr      *net.IPNet
+	adapter   string
+	index     int
+	noResolve bool
 }
 
 type RuleHost struct {
@@ -81,11 +85,9 @@ func (r *Rule) String() string {
 
 func New(rules []byte) (element *Filter) {
 	element = &Filter{
-		useGeoIP:          false,
-		useHosts:          false,
-		rulePort:          redblacktree.NewWithStringComparator(),
-		ruleDomains:       redblacktree.NewWithStringComparator(),
-		ruleSuffixDomains: redblacktree.NewWithStringComparator(),
+		useGeoIP:    false,
+		useHosts:    false,
+		rulePort: redblacktree.NewWithStringComparator(),
 	}
 	element.FromRules(rules)
 
@@ -139,6 +141,8 @@ func RuleType(rt byte) string {
 		return "user-agent"
 	case RuleTypeIPCIDR:
 		return "ip-cidr"
+	case RuleTypeIPCIDR6:
+		return "ip-cidr6"
 	case RuleTypeGeoIP:
 		return "geoip"
 	case RuleTypePort:
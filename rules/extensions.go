@@ -5,6 +5,8 @@ import (
 )
 
 func (c *Filter) FromExtensions(b []byte) {
+	c.Lock()
+	defer c.Unlock()
 	lines := strings.Split(string(b), "\n")
 	for _, line := range lines {
 		if strings.HasPrefix(line, "//") || strings.HasPrefix(line, "#") {
@@ -14,12 +16,15 @@ func (c *Filter) FromExtensions(b []byte) {
 		ruleName := strings.ToLower(items[0])
 		switch ruleName {
 		case "domain":
-			c.ruleDomains.Put(strings.ToLower(items[1]), &Rule{ruleType: RuleTypeDomains, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])})
+			r := &Rule{ruleType: RuleTypeDomains, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])}
+			c.ruleList.add(r)
 		case "domain-suffix":
-			c.ruleSuffixDomains.Put(strings.ToLower(items[1]), &Rule{ruleType: RuleTypeSuffixDomains, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])})
+			r := &Rule{ruleType: RuleTypeSuffixDomains, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])}
+			c.ruleList.add(r)
 		case "dst-port": // port white list
 			c.rulePort.Put(strings.ToLower(items[1]), &Rule{ruleType: RuleTypePort, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])})
 		}
 	}
+	c.ruleList.build()
 	return
 }
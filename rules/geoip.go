@@ -54,36 +54,25 @@ func (c *Filter) GeoIP(ip net.IP) string {
 	return country.Country.IsoCode
 }
 
-func resolveRequestIPAddr(host string) []net.IP {
-	var (
-		ips []net.IP
-		err error
-	)
-	ip := net.ParseIP(host)
-	if nil == ip {
-		ips, err = net.LookupIP(host)
-		if err != nil || len(ips) == 0 {
-			return nil
-		}
-	} else {
-		ips = []net.IP{ip}
-	}
-	return ips
-}
-
+// AddGeoIP appends a geoip rule after those already loaded.
 func (c *Filter) AddGeoIP(match, adapter string) {
-	c.ruleGeoIP = append(c.ruleGeoIP, &Rule{ruleType: RuleTypeGeoIP, word: strings.ToUpper(match), adapter: strings.ToUpper(adapter)})
+	c.Lock()
+	defer c.Unlock()
+	c.ruleList.add(&Rule{ruleType: RuleTypeGeoIP, word: strings.ToUpper(match), adapter: strings.ToUpper(adapter)})
 }
 
+// SetGeoIP replaces the adapter of the geoip rule for match, keeping its
+// position, or appends the rule if there is none.
 func (c *Filter) SetGeoIP(match, adapter string) {
 	rule := &Rule{ruleType: RuleTypeGeoIP, word: strings.ToUpper(match), adapter: strings.ToUpper(adapter)}
-	if c.ruleGeoIP != nil {
-		for i := 0; i < len(c.ruleGeoIP); i++ {
-			if c.ruleGeoIP[i].word == match {
-				c.ruleGeoIP[i] = rule
-				return
-			}
+	c.Lock()
+	defer c.Unlock()
+	for i, r := range c.ruleList.geoIPs {
+		if r.word == rule.word {
+			rule.index, rule.noResolve = r.index, r.noResolve
+			c.ruleList.geoIPs[i] = rule
+			return
 		}
 	}
-	c.ruleGeoIP = append(c.ruleGeoIP, rule)
+	c.ruleList.add(rule)
 }
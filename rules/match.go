@@ -55,17 +55,99 @@ func (c *Filter) MatchPort(port string) bool {
 }
 
 func (c *Filter) MatchRule(m goproxy.Metadata) goproxy.Rule {
+	ip := ""
+	if t := m.AddrType(); t == AddrTypeIPv4 || t == AddrTypeIPv6 {
+		ip = m.Host()
+	}
+	if r := c.matchRule(m, ip, m.Host()); r != nil {
+		return r
+	}
+	return c.final()
+}
+
+// MatchDomain runs the user-agent and domain rules only, then final. It
+// never resolves the host, so a DNS server can pick upstreams with it.
+func (c *Filter) MatchDomain(m goproxy.Metadata) goproxy.Rule {
+	if r := c.matchRule(m, "", ""); r != nil {
+		return r
+	}
+	return c.final()
+}
+
+// Result is what Filter.Match decided for a request.
+type Result struct {
+	Rule    *Rule  // the rule that matched
+	Addr    string // the hosts entry the host was rewritten to, if any
+	Adapter string
+}
+
+// Match evaluates every rule in order: bypass, hosts rewrite, port
+// allow-list, user-agent and domain rules, IP rules, then final. Domain
+// rules see the requested host and IP rules the rewritten address, so a
+// hosts entry saves resolving the name, or names the one resolved. A port
+// on the allow-list overrides every later rule, REJECT ones included.
+func (c *Filter) Match(m goproxy.Metadata) *Result {
 	host := m.Host()
-	switch m.AddrType() {
-	case AddrTypeDomainName:
-		if r := c.matchDomain(host); r != nil {
+	if c.MatchBypass(host) {
+		return &Result{Rule: &Rule{ruleType: RuleTypeBypass, word: host, adapter: ActionDirect}, Adapter: ActionDirect}
+	}
+	res := &Result{}
+	ip, target := "", host
+	if t := m.AddrType(); t == AddrTypeIPv4 || t == AddrTypeIPv6 {
+		ip = host
+	}
+	if addr := c.MatchHosts(host); addr != "" {
+		res.Addr = addr
+		if net.ParseIP(addr) != nil {
+			ip = addr
+		} else {
+			target = addr
+		}
+	}
+	if v, ok := c.rulePort.Get(m.Port()); ok {
+		res.Rule = v.(*Rule)
+	} else if res.Rule = c.matchRule(m, ip, target); res.Rule == nil {
+		res.Rule = c.final()
+	}
+	res.Adapter = res.Rule.adapter
+	return res
+}
+
+// matchRule runs the user-agent, domain and IP rules. ip is the address
+// IP rules are matched against. When it is empty and the host is a domain,
+// target is resolved for them, or they are skipped if target is empty too.
+// The rules are read under c's read lock, which the helpers below rely on.
+func (c *Filter) matchRule(m goproxy.Metadata, ip, target string) *Rule {
+	c.RLock()
+	defer c.RUnlock()
+	ua := ""
+	if hm, ok := m.(goproxy.HTTPMetadata); ok {
+		ua = hm.UserAgent()
+	}
+	if c.ordered {
+		return c.matchOrdered(m.Host(), m.AddrType() == AddrTypeDomainName, ua, ip, target)
+	}
+	if r := c.matchUserAgent(ua); r != nil {
+		return r
+	}
+	if m.AddrType() == AddrTypeDomainName {
+		if r := c.matchDomain(m.Host()); r != nil {
 			return r
 		}
-	case AddrTypeIPv4, AddrTypeIPv6:
-		if r := c.matchIpRule(host); r != nil {
+	}
+	if ip == "" && m.AddrType() == AddrTypeDomainName && c.ruleList.hasResolve {
+		// Resolved lazily, once no domain rule matched.
+		ip = target
+	}
+	if ip != "" {
+		if r := c.matchIpRule(ip, m.AddrType() == AddrTypeDomainName); r != nil {
 			return r
 		}
 	}
+	return nil
+}
+
+func (c *Filter) final() *Rule {
 	if c.ruleFinal != nil {
 		return c.ruleFinal
 	}
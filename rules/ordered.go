@@ -0,0 +1,153 @@
+package rules
+
+import (
+	"net"
+	"strings"
+)
+
+// ruleList keeps every rule with its position in the rule files, indexed by
+// type. Each index holds rules in file order, and maps keep the first rule
+// for a word, so the earliest match of every type is cheap to find.
+type ruleList struct {
+	count      int
+	resolve    int // index of the first IP rule without no-resolve
+	hasResolve bool
+	domains    map[string]*Rule
+	suffixes   suffixTrie
+	keywords   keywordMatcher
+	userAgents []*Rule
+	cidrs      cidrTree
+	geoIPs     []*Rule
+}
+
+// SetOrdered switches between evaluating rules in the order they were
+// written, first match wins, as Surge and Clash do, and the default where
+// domain rules beat keyword rules which beat IP rules. In ordered mode a
+// domain is resolved only when an IP rule comes before its first match.
+func (c *Filter) SetOrdered(ordered bool) {
+	c.Lock()
+	c.ordered = ordered
+	c.Unlock()
+}
+
+func (l *ruleList) add(r *Rule) {
+	if l.domains == nil {
+		l.domains = make(map[string]*Rule)
+	}
+	r.index = l.count
+	l.count++
+	if r.ruleType == RuleTypeGeoIP && !r.noResolve {
+		l.resolvable(r.index)
+	}
+	switch r.ruleType {
+	case RuleTypeDomains:
+		if _, ok := l.domains[r.word]; !ok {
+			l.domains[r.word] = r
+		}
+	case RuleTypeSuffixDomains:
+		l.suffixes.insert(r.word, r)
+	case RuleTypeKeywordDomains:
+		l.keywords.add(r)
+	case RuleTypeUserAgent:
+		l.userAgents = append(l.userAgents, r)
+	case RuleTypeGeoIP:
+		l.geoIPs = append(l.geoIPs, r)
+	}
+}
+
+func (l *ruleList) resolvable(index int) {
+	if !l.hasResolve {
+		l.resolve, l.hasResolve = index, true
+	}
+}
+
+// build prepares the indexes once rules have been added.
+func (l *ruleList) build() {
+	l.keywords.build()
+}
+
+func (l *ruleList) addIPCIDR(r *RuleIPCIDR) {
+	r.index = l.count
+	l.count++
+	if !r.noResolve {
+		l.resolvable(r.index)
+	}
+	l.cidrs.insert(r)
+}
+
+// matchOrdered returns the first rule in file order that matches. ip is the
+// address IP rules are matched against. When it is empty and the host is a
+// domain, target is resolved only if an IP rule comes before the best match
+// so far, and never if target is empty. Against the address of a domain,
+// no-resolve rules are skipped.
+func (c *Filter) matchOrdered(host string, domain bool, ua, ip, target string) *Rule {
+	resolved := domain
+	l := &c.ruleList
+	var best *Rule
+	better := func(r *Rule) bool {
+		return best == nil || r.index < best.index
+	}
+
+	if ua != "" {
+		ua = strings.ToLower(ua)
+		for _, r := range l.userAgents {
+			if !better(r) {
+				break
+			}
+			if globMatch(r.word, ua) {
+				best = r
+				break
+			}
+		}
+	}
+	if domain {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if r, ok := l.domains[host]; ok && better(r) {
+			best = r
+		}
+		l.suffixes.walk(host, func(r *Rule) {
+			if better(r) {
+				best = r
+			}
+		})
+		if r := l.keywords.first(c.keywordHost(host)); r != nil && better(r) {
+			best = r
+		}
+	}
+	var ips []net.IP
+	if ip != "" {
+		ips = []net.IP{net.ParseIP(ip)}
+	} else if target != "" && domain && l.hasResolve && (best == nil || l.resolve < best.index) {
+		ips = c.resolveIPs(target)
+	}
+	for _, addr := range ips {
+		if addr == nil {
+			continue
+		}
+		l.cidrs.walk(addr, func(rules []*RuleIPCIDR) {
+			for _, r := range rules {
+				if resolved && r.noResolve {
+					continue
+				}
+				if best == nil || r.index < best.index {
+					best = &Rule{ruleType: ipCIDRType(r), word: r.cidr.String(), adapter: r.adapter, index: r.index}
+				}
+				return
+			}
+		})
+	}
+	if len(ips) > 0 && len(l.geoIPs) > 0 && better(l.geoIPs[0]) {
+		if country := c.GeoIPs(ips); country != "" {
+			for _, r := range l.geoIPs {
+				if !better(r) {
+					break
+				}
+				if r.word == country && !(resolved && r.noResolve) {
+					best = r
+					break
+				}
+			}
+		}
+	}
+	return best
+}
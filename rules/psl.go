@@ -0,0 +1,38 @@
+package rules
+
+import (
+	"golang.org/x/net/publicsuffix"
+	"strings"
+)
+
+// SetPublicSuffix makes keyword rules match only the registrable name of
+// a host, the label left of its public suffix, using the Public Suffix
+// List built into golang.org/x/net. Then `domain-keyword,google` matches
+// www.google.com.hk but not google.example.com.
+func (c *Filter) SetPublicSuffix(enable bool) {
+	c.Lock()
+	c.publicSuffix = enable
+	c.Unlock()
+}
+
+// RegistrableDomain returns the eTLD+1 of host, example.co.uk for
+// a.b.example.co.uk, or host itself when it has none.
+func RegistrableDomain(host string) string {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(host, "."))
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+// keywordHost returns the part of host keyword rules are matched against.
+func (c *Filter) keywordHost(host string) string {
+	if !c.publicSuffix {
+		return host
+	}
+	domain := RegistrableDomain(host)
+	if i := strings.IndexByte(domain, '.'); i >= 0 {
+		return domain[:i]
+	}
+	return domain
+}
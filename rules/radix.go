@@ -0,0 +1,137 @@
+package rules
+
+import "net"
+
+// cidrTree holds path compressed binary radix (Patricia) trees of IP-CIDR
+// rules, one per family, so that an IPv6 network such as ::/0 never
+// matches an IPv4 address. Keys are the network address, left aligned.
+type cidrTree struct {
+	v4 *cidrNode
+	v6 *cidrNode
+}
+
+type cidrNode struct {
+	key   [net.IPv6len]byte
+	bits  int
+	rules []*RuleIPCIDR
+	child [2]*cidrNode
+}
+
+// cidrKey returns the tree key and prefix length of a network, and
+// whether it is an IPv4 one.
+func cidrKey(n *net.IPNet) ([net.IPv6len]byte, int, bool) {
+	var key [net.IPv6len]byte
+	ones, bits := n.Mask.Size()
+	v4 := bits == 8*net.IPv4len
+	if v4 {
+		copy(key[:], n.IP.To4())
+	} else {
+		copy(key[:], n.IP.To16())
+	}
+	return maskKey(key, ones), ones, v4
+}
+
+func maskKey(key [net.IPv6len]byte, bits int) [net.IPv6len]byte {
+	for i := range key {
+		switch {
+		case bits >= 8*(i+1):
+		case bits <= 8*i:
+			key[i] = 0
+		default:
+			key[i] &= ^byte(0xFF >> uint(bits-8*i))
+		}
+	}
+	return key
+}
+
+func keyBit(key [net.IPv6len]byte, i int) int {
+	return int(key[i/8]>>uint(7-i%8)) & 1
+}
+
+// commonBits returns how many leading bits a and b share, up to limit.
+func commonBits(a, b [net.IPv6len]byte, limit int) int {
+	n := 0
+	for i := 0; i < net.IPv6len && n < limit; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	if n > limit {
+		return limit
+	}
+	return n
+}
+
+func (t *cidrTree) insert(r *RuleIPCIDR) {
+	key, bits, v4 := cidrKey(r.cidr)
+	p := &t.v6
+	if v4 {
+		p = &t.v4
+	}
+	for {
+		n := *p
+		if n == nil {
+			*p = &cidrNode{key: key, bits: bits, rules: []*RuleIPCIDR{r}}
+			return
+		}
+		limit := n.bits
+		if bits < limit {
+			limit = bits
+		}
+		common := commonBits(n.key, key, limit)
+		switch {
+		case common == n.bits && common == bits:
+			n.rules = append(n.rules, r)
+			return
+		case common == n.bits:
+			p = &n.child[keyBit(key, n.bits)]
+			continue
+		case common == bits:
+			// The new network contains n.
+			parent := &cidrNode{key: key, bits: bits, rules: []*RuleIPCIDR{r}}
+			parent.child[keyBit(n.key, bits)] = n
+			*p = parent
+		default:
+			split := &cidrNode{key: maskKey(key, common), bits: common}
+			split.child[keyBit(n.key, common)] = n
+			split.child[keyBit(key, common)] = &cidrNode{key: key, bits: bits, rules: []*RuleIPCIDR{r}}
+			*p = split
+		}
+		return
+	}
+}
+
+// walk calls fn with the rules of every network containing ip, from the
+// shortest prefix to the longest, rules of the same network in the order
+// they were inserted.
+func (t *cidrTree) walk(ip net.IP, fn func([]*RuleIPCIDR)) {
+	var key [net.IPv6len]byte
+	root, size := t.v6, 8*net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(key[:], ip4)
+		root, size = t.v4, 8*net.IPv4len
+	} else if ip16 := ip.To16(); ip16 != nil {
+		copy(key[:], ip16)
+	} else {
+		return
+	}
+	for n := root; n != nil; {
+		if commonBits(n.key, key, n.bits) < n.bits {
+			return
+		}
+		if len(n.rules) > 0 {
+			fn(n.rules)
+		}
+		if n.bits == size {
+			return
+		}
+		n = n.child[keyBit(key, n.bits)]
+	}
+}
@@ -0,0 +1,103 @@
+package rules
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	resolveCacheSize   = 4096
+	resolveNegativeTTL = 10 * time.Second
+)
+
+// Resolver resolves domains for IP rules. dns.Server and
+// dns_resolver.DnsResolver satisfy it.
+type Resolver interface {
+	LookupHost(host string) ([]net.IP, error)
+}
+
+// TTLResolver is a Resolver that also reports how long an answer may be
+// cached.
+type TTLResolver interface {
+	Resolver
+	LookupHostTTL(host string) ([]net.IP, time.Duration, error)
+}
+
+type resolveCache struct {
+	sync.Mutex
+	resolver Resolver
+	ttl      time.Duration
+	m        map[string]*resolveEntry
+}
+
+type resolveEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// SetResolver makes IP rules match domain requests too, by resolving the
+// domain with resolver when an IP rule without no-resolve is reached and
+// no earlier rule matched. Answers are cached for their TTL if resolver is
+// a TTLResolver, or for ttl otherwise. Without a resolver, IP rules only
+// match IP requests and hosts entries.
+func (c *Filter) SetResolver(resolver Resolver, ttl time.Duration) {
+	c.Lock()
+	if resolver == nil {
+		c.resolver = nil
+	} else {
+		c.resolver = &resolveCache{resolver: resolver, ttl: ttl, m: make(map[string]*resolveEntry)}
+	}
+	c.Unlock()
+}
+
+// resolveIPs returns the addresses of host, which may be an IP.
+func (c *Filter) resolveIPs(host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	rc := c.resolver
+	if rc == nil {
+		return nil
+	}
+	return rc.lookup(host)
+}
+
+// lookup answers from the cache, resolving host on a miss. Failures are
+// cached briefly so a dead name does not cost a query per request.
+func (rc *resolveCache) lookup(host string) []net.IP {
+	now := time.Now()
+	rc.Lock()
+	e, ok := rc.m[host]
+	rc.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.ips
+	}
+
+	var ips []net.IP
+	var err error
+	ttl := rc.ttl
+	if r, ok := rc.resolver.(TTLResolver); ok {
+		ips, ttl, err = r.LookupHostTTL(host)
+	} else {
+		ips, err = rc.resolver.LookupHost(host)
+	}
+	if err != nil || len(ips) == 0 {
+		ips, ttl = nil, resolveNegativeTTL
+	}
+
+	rc.Lock()
+	if len(rc.m) >= resolveCacheSize {
+		for k, v := range rc.m {
+			if now.After(v.expires) {
+				delete(rc.m, k)
+			}
+		}
+		if len(rc.m) >= resolveCacheSize {
+			rc.m = make(map[string]*resolveEntry)
+		}
+	}
+	rc.m[host] = &resolveEntry{ips: ips, expires: now.Add(ttl)}
+	rc.Unlock()
+	return ips
+}
@@ -13,7 +13,20 @@ func readArrayLine(source string) []string {
 	return out
 }
 
+// noResolve reports whether an IP rule line has the no-resolve option,
+// which keeps it from matching the resolved address of a domain.
+func noResolve(items []string) bool {
+	for _, v := range items[3:] {
+		if strings.EqualFold(v, "no-resolve") {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Filter) FromRules(b []byte) {
+	c.Lock()
+	defer c.Unlock()
 	str := strings.ReplaceAll(string(b), "\r", "")
 	lines := strings.Split(str, "\n")
 	for _, line := range lines {
@@ -29,21 +42,27 @@ func (c *Filter) FromRules(b []byte) {
 		ruleName := strings.ToLower(items[0])
 		switch ruleName {
 		case "user-agent":
-			c.ruleUserAgent = append(c.ruleUserAgent, &Rule{ruleType: RuleTypeUserAgent, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])})
+			r := &Rule{ruleType: RuleTypeUserAgent, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])}
+			c.ruleList.add(r)
 		case "domain":
-			c.ruleDomains.Put(strings.ToLower(items[1]), &Rule{ruleType: RuleTypeSuffixDomains, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])})
+			r := &Rule{ruleType: RuleTypeDomains, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])}
+			c.ruleList.add(r)
 		case "domain-suffix":
-			c.ruleSuffixDomains.Put(strings.ToLower(items[1]), &Rule{ruleType: RuleTypeSuffixDomains, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])})
+			r := &Rule{ruleType: RuleTypeSuffixDomains, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])}
+			c.ruleList.add(r)
 		case "domain-keyword":
-			c.ruleKeywordDomains = append(c.ruleKeywordDomains, &Rule{ruleType: RuleTypeKeywordDomains, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])})
-		case "ip-cidr":
+			r := &Rule{ruleType: RuleTypeKeywordDomains, word: strings.ToLower(items[1]), adapter: strings.ToUpper(items[2])}
+			c.ruleList.add(r)
+		case "ip-cidr", "ip-cidr6":
 			_, cidr, err := net.ParseCIDR(items[1])
 			if err != nil {
 				continue
 			}
-			c.ruleIPCIDR = append(c.ruleIPCIDR, &RuleIPCIDR{cidr: cidr, adapter: strings.ToUpper(items[2])})
+			r := &RuleIPCIDR{cidr: cidr, adapter: strings.ToUpper(items[2]), noResolve: noResolve(items)}
+			c.ruleList.addIPCIDR(r)
 		case "geoip":
-			c.ruleGeoIP = append(c.ruleGeoIP, &Rule{ruleType: RuleTypeGeoIP, word: strings.ToUpper(items[1]), adapter: strings.ToUpper(items[2])})
+			r := &Rule{ruleType: RuleTypeGeoIP, word: strings.ToUpper(items[1]), adapter: strings.ToUpper(items[2]), noResolve: noResolve(items)}
+			c.ruleList.add(r)
 		case "final":
 			c.ruleFinal = &Rule{ruleType: RuleTypeMATCH, word: "match", adapter: strings.ToUpper(items[1])}
 		case "match":
@@ -51,6 +70,8 @@ func (c *Filter) FromRules(b []byte) {
 		}
 	}
 
+	c.ruleList.build()
+
 	c.bypassDomains = make([]interface{}, len(c.systemBypass))
 	for i, v := range c.systemBypass {
 		ip := net.ParseIP(v)
@@ -66,58 +87,80 @@ func (c *Filter) FromRules(b []byte) {
 	return
 }
 
-func (c *Filter) matchDomain(host string) *Rule {
-	if v, ok := c.ruleDomains.Get(host); ok {
-		return v.(*Rule)
-	}
-	suffix := domainSuffix(host)
-	if v, ok := c.ruleSuffixDomains.Get(suffix); ok {
-		return v.(*Rule)
+// matchUserAgent matches user-agent rules in the order they were given.
+func (c *Filter) matchUserAgent(ua string) *Rule {
+	if ua == "" {
+		return nil
 	}
-	keyword := domainKeyword(host)
-	for _, v := range c.ruleKeywordDomains {
-		if v.word == keyword {
+	ua = strings.ToLower(ua)
+	for _, v := range c.ruleList.userAgents {
+		if globMatch(v.word, ua) {
 			return v
 		}
 	}
-	country := domainCountry(host)
-	if v, ok := c.ruleSuffixDomains.Get(country); ok {
-		return v.(*Rule)
-	}
-
 	return nil
 }
 
-// addr = host/not port
-func (c *Filter) matchIpRule(addr string) *Rule {
-	ips := resolveRequestIPAddr(addr) //  convert []net.IP
-	r := c.matchIPCIDR(ips)           // IP-CIDR rule
+// matchDomain tries exact domain rules, then the most specific suffix
+// rule, then the earliest keyword rule found in the host.
+func (c *Filter) matchDomain(host string) *Rule {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if r, ok := c.ruleList.domains[host]; ok {
+		return r
+	}
+	var suffix *Rule
+	c.ruleList.suffixes.walk(host, func(r *Rule) {
+		suffix = r
+	})
+	if suffix != nil {
+		return suffix
+	}
+	return c.ruleList.keywords.first(c.keywordHost(host))
+}
+
+// addr = host/not port. resolved is set when addr is the address of a
+// domain, which no-resolve rules do not match.
+func (c *Filter) matchIpRule(addr string, resolved bool) *Rule {
+	ips := c.resolveIPs(addr)         // convert []net.IP
+	r := c.matchIPCIDR(ips, resolved) // IP-CIDR rule
 	if r != nil {
-		return &Rule{ruleType: RuleTypeIPCIDR, word: addr, adapter: r.adapter}
+		return &Rule{ruleType: ipCIDRType(r), word: addr, adapter: r.adapter}
 	}
 	if nil != ips { // GEOIP rule
 		country := c.GeoIPs(ips) // return country
-		if c.ruleGeoIP != nil {
-			for _, v := range c.ruleGeoIP {
-				if v.word == country {
-					return v
-				}
+		for _, v := range c.ruleList.geoIPs {
+			if v.word == country && !(resolved && v.noResolve) {
+				return v
 			}
 		}
 	}
 	return nil
 }
 
-func (c *Filter) matchIPCIDR(ip []net.IP) *RuleIPCIDR {
-	if c.ruleIPCIDR != nil {
-		for _, addr := range ip {
-			for _, v := range c.ruleIPCIDR {
-				if v.cidr.Contains(addr) {
-					return v
+// matchIPCIDR returns the rule with the longest prefix containing one of
+// ip, the first given on a tie.
+func (c *Filter) matchIPCIDR(ip []net.IP, resolved bool) *RuleIPCIDR {
+	for _, addr := range ip {
+		var best *RuleIPCIDR
+		c.ruleList.cidrs.walk(addr, func(rules []*RuleIPCIDR) {
+			for _, r := range rules {
+				if !(resolved && r.noResolve) {
+					best = r
+					return
 				}
 			}
+		})
+		if best != nil {
+			return best
 		}
 	}
 
 	return nil
 }
+
+func ipCIDRType(r *RuleIPCIDR) byte {
+	if r.cidr.IP.To4() == nil {
+		return RuleTypeIPCIDR6
+	}
+	return RuleTypeIPCIDR
+}
@@ -0,0 +1,375 @@
+package rules
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/koomox/goproxy/tunnel"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"curl*", "curl/8.0", true},
+		{"curl*", "xcurl/8.0", false},
+		{"*cfnetwork*", "app/1 cfnetwork/1240 darwin/20", true},
+		{"mozilla*safari*", "mozilla/5.0 (macintosh) safari/605", true},
+		{"mozilla*safari", "mozilla/5.0 safari/605", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestMatchRuleUserAgent(t *testing.T) {
+	f := New([]byte("USER-AGENT,*CFNetwork*,REJECT\nDOMAIN-SUFFIX,example.com,PROXY\nFINAL,DIRECT"))
+	addr, _ := tunnel.ResolveAddr("tcp", "www.example.com:443")
+
+	m := &tunnel.Metadata{Command: tunnel.Connect, Address: addr, HTTP: &tunnel.HTTPRequest{UserAgent: "App/1 CFNetwork/1240"}}
+	if r := f.MatchRule(m); r.RuleType() != RuleTypeUserAgent || r.Adapter() != ActionReject {
+		t.Errorf("got %v %v, want user-agent rule", r, r.Adapter())
+	}
+	m.HTTP.UserAgent = "curl/8.0"
+	if r := f.MatchRule(m); r.Adapter() != ActionProxy {
+		t.Errorf("got %v %v, want domain rule", r, r.Adapter())
+	}
+	m.HTTP = nil
+	if r := f.MatchRule(m); r.Adapter() != ActionProxy {
+		t.Errorf("got %v %v without http, want domain rule", r, r.Adapter())
+	}
+}
+
+func TestMatchPipeline(t *testing.T) {
+	f := New([]byte("skip-proxy = 192.168.0.0/16, localhost\nDOMAIN-SUFFIX,example.com,PROXY\nDOMAIN,blocked.test,REJECT\nIP-CIDR,10.0.0.0/8,REJECT\nFINAL,DIRECT"))
+	f.ruleHosts = []*RuleHost{{Addr: "10.1.2.3", Host: "intranet.test"}}
+	f.FromPort("8443")
+
+	tests := []struct {
+		addr     string
+		ruleType byte
+		rewrite  string
+		adapter  string
+	}{
+		{"localhost:80", RuleTypeBypass, "", ActionDirect},
+		{"192.168.1.1:80", RuleTypeBypass, "", ActionDirect},
+		{"intranet.test:80", RuleTypeIPCIDR, "10.1.2.3", ActionReject},
+		{"www.example.com:8443", RuleTypePort, "", ActionAccept},
+		// The allow-list overrides REJECT rules too.
+		{"blocked.test:8443", RuleTypePort, "", ActionAccept},
+		{"blocked.test:443", RuleTypeDomains, "", ActionReject},
+		{"www.example.com:443", RuleTypeSuffixDomains, "", ActionProxy},
+		{"10.0.0.1:443", RuleTypeIPCIDR, "", ActionReject},
+		{"1.1.1.1:443", RuleTypeMATCH, "", ActionDirect},
+	}
+	for _, tt := range tests {
+		addr, err := tunnel.ResolveAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := f.Match(&tunnel.Metadata{Command: tunnel.Connect, Address: addr})
+		if res.Rule.RuleType() != tt.ruleType || res.Addr != tt.rewrite || res.Adapter != tt.adapter {
+			t.Errorf("%v: got %v %q %v, want %v %q %v", tt.addr, res.Rule, res.Addr, res.Adapter, RuleType(tt.ruleType), tt.rewrite, tt.adapter)
+		}
+	}
+}
+
+func TestMatchOrdered(t *testing.T) {
+	f := New([]byte("DOMAIN-KEYWORD,google,REJECT\nDOMAIN-SUFFIX,google.com,PROXY\nIP-CIDR,10.0.0.0/8,DIRECT\nDOMAIN-SUFFIX,corp.test,PROXY\nDOMAIN-SUFFIX,co.uk,REJECT\nDOMAIN,api.example.co.uk,PROXY\nFINAL,PROXY"))
+	f.ruleHosts = []*RuleHost{{Addr: "10.1.2.3", Host: "git.corp.test"}}
+
+	match := func(addr string) *Result {
+		a, err := tunnel.ResolveAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.Match(&tunnel.Metadata{Command: tunnel.Connect, Address: a})
+	}
+	if res := match("www.google.com:443"); res.Adapter != ActionProxy {
+		t.Errorf("unordered got %v %v, want suffix rule", res.Rule, res.Adapter)
+	}
+
+	f.SetOrdered(true)
+	tests := []struct {
+		addr     string
+		ruleType byte
+		adapter  string
+	}{
+		{"www.google.com:443", RuleTypeKeywordDomains, ActionReject},
+		{"git.corp.test:22", RuleTypeIPCIDR, ActionDirect},
+		{"www.corp.test:443", RuleTypeSuffixDomains, ActionProxy},
+		{"api.example.co.uk:443", RuleTypeSuffixDomains, ActionReject},
+		{"10.9.9.9:80", RuleTypeIPCIDR, ActionDirect},
+		{"1.1.1.1:80", RuleTypeMATCH, ActionProxy},
+	}
+	for _, tt := range tests {
+		if res := match(tt.addr); res.Rule.RuleType() != tt.ruleType || res.Adapter != tt.adapter {
+			t.Errorf("%v: got %v %v, want %v %v", tt.addr, res.Rule, res.Adapter, RuleType(tt.ruleType), tt.adapter)
+		}
+	}
+}
+
+func TestSetGeoIP(t *testing.T) {
+	f := New([]byte("GEOIP,CN,DIRECT\nDOMAIN,example.com,PROXY"))
+	f.AddGeoIP("us", "proxy")
+	f.SetGeoIP("cn", "reject")
+	l := &f.ruleList
+	if len(l.geoIPs) != 2 {
+		t.Fatalf("%d geoip rules, want 2", len(l.geoIPs))
+	}
+	if r := l.geoIPs[0]; r.word != "CN" || r.adapter != ActionReject || r.index != 0 {
+		t.Errorf("SetGeoIP gave %+v, want CN REJECT in place", r)
+	}
+	if r := l.geoIPs[1]; r.word != "US" || r.index != 2 {
+		t.Errorf("AddGeoIP gave %+v, want US after the loaded rules", r)
+	}
+}
+
+func TestSetGeoIPWhileMatching(t *testing.T) {
+	f := New([]byte("GEOIP,CN,DIRECT\nIP-CIDR,10.0.0.0/8,REJECT\nFINAL,PROXY"))
+	addr, _ := tunnel.ResolveAddr("tcp", "192.0.2.1:80")
+	m := &tunnel.Metadata{Command: tunnel.Connect, Address: addr}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			f.AddGeoIP("us", "proxy")
+			f.SetGeoIP("cn", "reject")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if r := f.Match(m); r.Adapter != ActionProxy {
+			t.Fatalf("got %v, want PROXY", r.Adapter)
+		}
+	}
+	<-done
+}
+
+func TestMatchDomainFirstRule(t *testing.T) {
+	f := New([]byte("DOMAIN,example.com,PROXY\nUSER-AGENT,curl*,DIRECT\nUSER-AGENT,curl/8*,REJECT"))
+	f.FromExtensions([]byte("DOMAIN,example.com,REJECT"))
+	if r := f.matchDomain("example.com"); r == nil || r.adapter != ActionProxy {
+		t.Errorf("got %v, want the first domain rule", r)
+	}
+	if r := f.matchUserAgent("curl/8.0"); r == nil || r.adapter != ActionDirect {
+		t.Errorf("got %v, want the first user-agent rule", r)
+	}
+}
+
+func TestMatchDomainSuffixAndKeyword(t *testing.T) {
+	f := New([]byte("DOMAIN-SUFFIX,co.uk,REJECT\nDOMAIN-SUFFIX,example.co.uk,PROXY\nDOMAIN-SUFFIX,github.io,DIRECT\nDOMAIN-SUFFIX,.cn,DIRECT\nDOMAIN-KEYWORD,google,PROXY\nDOMAIN-KEYWORD,ads,REJECT\nDOMAIN-KEYWORD,oogle,DIRECT"))
+	tests := []struct {
+		host    string
+		adapter string
+	}{
+		{"a.b.example.co.uk", ActionProxy},
+		{"example.co.uk", ActionProxy},
+		{"other.co.uk", ActionReject},
+		{"foo.github.io", ActionDirect},
+		{"www.baidu.cn", ActionDirect},
+		{"notexample.co.uk", ActionReject},
+		{"www.google.com.hk", ActionProxy},
+		{"googleapis.com", ActionProxy},
+		{"ads.doubleclick.net", ActionReject},
+		{"uk", ""},
+		{"example.com", ""},
+	}
+	for _, tt := range tests {
+		r := f.matchDomain(tt.host)
+		if tt.adapter == "" && r != nil || tt.adapter != "" && (r == nil || r.adapter != tt.adapter) {
+			t.Errorf("%v: got %v, want %v", tt.host, r, tt.adapter)
+		}
+	}
+
+	f.SetPublicSuffix(true)
+	if r := f.matchDomain("www.google.com.hk"); r == nil || r.adapter != ActionProxy {
+		t.Errorf("registrable name keyword got %v", r)
+	}
+	if r := f.matchDomain("google.example.com"); r != nil {
+		t.Errorf("subdomain keyword got %v, want no match", r)
+	}
+	if got := RegistrableDomain("a.b.example.co.uk"); got != "example.co.uk" {
+		t.Errorf("RegistrableDomain got %v", got)
+	}
+}
+
+func TestKeywordMatcher(t *testing.T) {
+	var m keywordMatcher
+	words := []string{"he", "she", "his", "hers"}
+	for i, w := range words {
+		m.add(&Rule{word: w, index: i})
+	}
+	m.build()
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"ushers", "he"},
+		{"xshex", "he"},
+		{"this", "his"},
+		{"hxrs", ""},
+	}
+	for _, tt := range tests {
+		r := m.first(tt.s)
+		if tt.want == "" && r != nil || tt.want != "" && (r == nil || r.word != tt.want) {
+			t.Errorf("first(%q) = %v, want %q", tt.s, r, tt.want)
+		}
+	}
+}
+
+func TestCIDRTree(t *testing.T) {
+	var tree cidrTree
+	var all []*RuleIPCIDR
+	for i, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32", "0.0.0.0/0", "192.168.0.0/16", "2001:db8::/32", "2001:db8:1::/48", "10.1.0.0/16"} {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &RuleIPCIDR{cidr: cidr, adapter: s, index: i}
+		all = append(all, r)
+		tree.insert(r)
+	}
+	tests := []struct {
+		ip, want string
+	}{
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"10.1.2.4", "10.1.2.0/24"},
+		{"10.1.3.1", "10.1.0.0/16"},
+		{"10.2.0.1", "10.0.0.0/8"},
+		{"8.8.8.8", "0.0.0.0/0"},
+		{"2001:db8:1::1", "2001:db8:1::/48"},
+		{"2001:db8:2::1", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+	}
+	for _, tt := range tests {
+		var got *RuleIPCIDR
+		tree.walk(net.ParseIP(tt.ip), func(rules []*RuleIPCIDR) {
+			got = rules[0]
+		})
+		if tt.want == "" && got != nil || tt.want != "" && (got == nil || got.adapter != tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.ip, got, tt.want)
+		}
+		if got != nil && got.index == 8 {
+			t.Errorf("%v: duplicate network did not keep the first rule", tt.ip)
+		}
+	}
+}
+
+func TestCIDRFamilies(t *testing.T) {
+	f := New([]byte("IP-CIDR6,::/0,REJECT\nIP-CIDR6,::ffff:0:0/96,REJECT\nIP-CIDR,0.0.0.0/0,PROXY\nFINAL,DIRECT"))
+	tests := []struct {
+		addr, adapter string
+	}{
+		{"1.2.3.4:80", ActionProxy},
+		{"[2001:db8::1]:80", ActionReject},
+	}
+	for _, ordered := range []bool{false, true} {
+		f.SetOrdered(ordered)
+		for _, tt := range tests {
+			addr, err := tunnel.ResolveAddr("tcp", tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res := f.Match(&tunnel.Metadata{Command: tunnel.Connect, Address: addr}); res.Adapter != tt.adapter {
+				t.Errorf("ordered %v %v: got %v %v, want %v", ordered, tt.addr, res.Rule, res.Adapter, tt.adapter)
+			}
+		}
+	}
+}
+
+func TestMatchIPCIDR6NoResolve(t *testing.T) {
+	f := New([]byte("IP-CIDR,10.0.0.0/8,REJECT,no-resolve\nIP-CIDR6,2001:db8::/32,PROXY\nFINAL,DIRECT"))
+	f.ruleHosts = []*RuleHost{{Addr: "10.1.2.3", Host: "intranet.test"}, {Addr: "2001:db8::1", Host: "v6.test"}}
+	tests := []struct {
+		addr     string
+		ruleType byte
+	}{
+		{"10.1.2.3:80", RuleTypeIPCIDR},
+		{"intranet.test:80", RuleTypeMATCH},
+		{"[2001:db8::5]:443", RuleTypeIPCIDR6},
+		{"v6.test:443", RuleTypeIPCIDR6},
+	}
+	for _, ordered := range []bool{false, true} {
+		f.SetOrdered(ordered)
+		for _, tt := range tests {
+			addr, err := tunnel.ResolveAddr("tcp", tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res := f.Match(&tunnel.Metadata{Command: tunnel.Connect, Address: addr}); res.Rule.RuleType() != tt.ruleType {
+				t.Errorf("ordered %v %v: got %v, want %v", ordered, tt.addr, res.Rule, RuleType(tt.ruleType))
+			}
+		}
+	}
+}
+
+type countingResolver struct {
+	hosts   map[string]string
+	lookups int
+}
+
+func (r *countingResolver) LookupHost(host string) ([]net.IP, error) {
+	r.lookups++
+	if ip, ok := r.hosts[host]; ok {
+		return []net.IP{net.ParseIP(ip)}, nil
+	}
+	return nil, errors.New("NXDOMAIN")
+}
+
+func TestMatchResolvesHostsTarget(t *testing.T) {
+	f := New([]byte("IP-CIDR,10.0.0.0/8,REJECT\nFINAL,DIRECT"))
+	f.ruleHosts = []*RuleHost{{Addr: "b.test", Host: "a.test"}}
+	resolver := &countingResolver{hosts: map[string]string{"b.test": "10.1.1.1"}}
+	addr, _ := tunnel.ResolveAddr("tcp", "a.test:80")
+	for _, ordered := range []bool{false, true} {
+		f.SetOrdered(ordered)
+		f.SetResolver(resolver, time.Minute)
+		res := f.Match(&tunnel.Metadata{Command: tunnel.Connect, Address: addr})
+		if res.Addr != "b.test" || res.Adapter != ActionReject {
+			t.Errorf("ordered %v: got %v %q %v, want the rule of b.test", ordered, res.Rule, res.Addr, res.Adapter)
+		}
+	}
+}
+
+func TestMatchResolvesLazily(t *testing.T) {
+	f := New([]byte("DOMAIN-SUFFIX,example.com,PROXY\nIP-CIDR,93.184.0.0/16,REJECT\nIP-CIDR,10.0.0.0/8,DIRECT,no-resolve\nFINAL,DIRECT"))
+	resolver := &countingResolver{hosts: map[string]string{"www.example.com": "93.184.1.1", "cdn.test": "93.184.2.2", "lan.test": "10.0.0.1"}}
+	f.SetResolver(resolver, time.Minute)
+
+	match := func(addr string) *Result {
+		a, err := tunnel.ResolveAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.Match(&tunnel.Metadata{Command: tunnel.Connect, Address: a})
+	}
+	for _, ordered := range []bool{false, true} {
+		f.SetOrdered(ordered)
+		f.SetResolver(resolver, time.Minute)
+		resolver.lookups = 0
+		if res := match("www.example.com:443"); res.Adapter != ActionProxy || resolver.lookups != 0 {
+			t.Errorf("ordered %v: domain rule got %v after %d lookups", ordered, res.Adapter, resolver.lookups)
+		}
+		if res := match("cdn.test:443"); res.Rule.RuleType() != RuleTypeIPCIDR || res.Adapter != ActionReject {
+			t.Errorf("ordered %v: resolved domain got %v %v", ordered, res.Rule, res.Adapter)
+		}
+		if res := match("lan.test:443"); res.Rule.RuleType() != RuleTypeMATCH {
+			t.Errorf("ordered %v: no-resolve rule matched resolved domain: %v", ordered, res.Rule)
+		}
+		match("cdn.test:443")
+		match("missing.test:443")
+		match("missing.test:443")
+		if resolver.lookups != 3 {
+			t.Errorf("ordered %v: %d lookups, want 3 with caching", ordered, resolver.lookups)
+		}
+	}
+}
@@ -9,76 +9,29 @@ var (
 	domainExpMustCompile = regexp.MustCompile(`[a-zA-Z0-9][a-zA-Z0-9_-]{0,62}(\.[a-zA-Z0-9][a-zA-Z0-9_-]{0,62})*(\.[a-zA-Z][a-zA-Z0-9]{0,10}){1}`)
 )
 
-func domainSuffix(s string) string {
-	i := len(s)
-	count := 0
-	end := 0
-	for ; i != 0; i-- {
-		if s[i-1] == '.' {
-			if (i - 1) == 0 {
-				return s
-			}
-			count += 1
-			switch count {
-			case 1:
-				end = i - 1
-			case 2:
-				switch s[i:end] {
-				case "com", "co", "gov", "edu", "org", "net":
-					end = i - 1
-				default:
-					return s[i:]
-				}
-			default:
-				return s[i:]
-			}
+// globMatch reports whether s matches pattern, where * matches any run of
+// characters, as in Surge USER-AGENT rules.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case p < len(pattern) && pattern[p] == s[i]:
+			p++
+			i++
+		case star >= 0:
+			// Let the last * swallow one more character.
+			next++
+			p, i = star+1, next
+		default:
+			return false
 		}
 	}
-	if count == 0 {
-		return ""
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
 	}
-
-	return s
-}
-
-func domainKeyword(s string) string {
-	i := len(s)
-	count := 0
-	end := i
-	for ; i != 0; i-- {
-		if s[i-1] == '.' {
-			if (i - 1) == 0 {
-				return s[:end]
-			}
-			count += 1
-			switch count {
-			case 1:
-				end = i - 1
-			case 2:
-				switch s[i:end] {
-				case "com", "co", "gov", "edu", "org", "net":
-					end = i - 1
-				default:
-					return s[i:end]
-				}
-			default:
-				return s[i:end]
-			}
-		}
-	}
-	if count == 0 {
-		return ""
-	}
-
-	return s[i:end]
-}
-
-func domainCountry(s string) string {
-	i := len(s)
-	for ; i != 0; i-- {
-		if s[i-1] == '.' {
-			return s[i-1:]
-		}
-	}
-	return s
+	return p == len(pattern)
 }
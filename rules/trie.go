@@ -0,0 +1,155 @@
+package rules
+
+import "strings"
+
+// suffixTrie holds domain suffix rules keyed by reversed labels, so that a
+// host is matched against all of its parent domains in one walk.
+type suffixTrie struct {
+	children map[string]*suffixTrie
+	rule     *Rule
+}
+
+// insert adds a rule for domain and all its subdomains, keeping the first
+// rule given for a domain.
+func (t *suffixTrie) insert(domain string, r *Rule) {
+	domain = strings.Trim(domain, ".")
+	if domain == "" {
+		return
+	}
+	node := t
+	for domain != "" {
+		label := domain
+		if i := strings.LastIndexByte(domain, '.'); i >= 0 {
+			label, domain = domain[i+1:], domain[:i]
+		} else {
+			domain = ""
+		}
+		if node.children == nil {
+			node.children = make(map[string]*suffixTrie)
+		}
+		next, ok := node.children[label]
+		if !ok {
+			next = &suffixTrie{}
+			node.children[label] = next
+		}
+		node = next
+	}
+	if node.rule == nil {
+		node.rule = r
+	}
+}
+
+// walk calls fn with the rule of every suffix of host, from the top level
+// domain down to host itself.
+func (t *suffixTrie) walk(host string, fn func(*Rule)) {
+	node := t
+	for host != "" {
+		label := host
+		if i := strings.LastIndexByte(host, '.'); i >= 0 {
+			label, host = host[i+1:], host[:i]
+		} else {
+			host = ""
+		}
+		if node = node.children[label]; node == nil {
+			return
+		}
+		if node.rule != nil {
+			fn(node.rule)
+		}
+	}
+}
+
+// keywordMatcher finds every keyword rule contained in a string with an
+// Aho–Corasick automaton, in one pass however many keywords there are.
+type keywordMatcher struct {
+	rules []*Rule
+	nodes []acNode
+}
+
+type acNode struct {
+	next map[byte]int
+	fail int
+	out  []*Rule
+}
+
+func (m *keywordMatcher) add(r *Rule) {
+	m.rules = append(m.rules, r)
+	m.nodes = nil
+}
+
+func (m *keywordMatcher) build() {
+	m.nodes = []acNode{{}}
+	for _, r := range m.rules {
+		if r.word == "" {
+			continue
+		}
+		n := 0
+		for i := 0; i < len(r.word); i++ {
+			c := r.word[i]
+			if m.nodes[n].next == nil {
+				m.nodes[n].next = make(map[byte]int)
+			}
+			next, ok := m.nodes[n].next[c]
+			if !ok {
+				next = len(m.nodes)
+				m.nodes = append(m.nodes, acNode{})
+				m.nodes[n].next[c] = next
+			}
+			n = next
+		}
+		m.nodes[n].out = append(m.nodes[n].out, r)
+	}
+
+	// Breadth first, so the fail node of every node is done before it.
+	queue := make([]int, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for c, child := range m.nodes[n].next {
+			f := m.nodes[n].fail
+			for {
+				if next, ok := m.nodes[f].next[c]; ok {
+					m.nodes[child].fail = next
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			m.nodes[child].out = append(m.nodes[child].out, m.nodes[m.nodes[child].fail].out...)
+			queue = append(queue, child)
+		}
+	}
+}
+
+// first returns the earliest given keyword rule contained in s. The
+// automaton must have been built since the last add.
+func (m *keywordMatcher) first(s string) *Rule {
+	if len(m.nodes) == 0 {
+		return nil
+	}
+	var best *Rule
+	n := 0
+	for i := 0; i < len(s); i++ {
+		for {
+			if next, ok := m.nodes[n].next[s[i]]; ok {
+				n = next
+				break
+			}
+			if n == 0 {
+				break
+			}
+			n = m.nodes[n].fail
+		}
+		for _, r := range m.nodes[n].out {
+			if best == nil || r.index < best.index {
+				best = r
+			}
+		}
+	}
+	return best
+}
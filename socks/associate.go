@@ -0,0 +1,170 @@
+package socks
+
+import (
+	"context"
+	"github.com/koomox/goproxy/tunnel"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// association is a UDP ASSOCIATE request. It lives as long as the TCP
+// control connection that made it, and only admits datagrams from the
+// client address declared in the request.
+type association struct {
+	ip     net.IP
+	port   int
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Ranks of the match of a datagram source against an association.
+const (
+	matchNone = iota
+	matchIP   // a zero port in the request matches any source port
+	matchExact
+)
+
+// match ranks how a datagram from addr belongs to the association.
+func (a *association) match(addr net.Addr) int {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || !udpAddr.IP.Equal(a.ip) {
+		return matchNone
+	}
+	if a.port == udpAddr.Port {
+		return matchExact
+	}
+	if a.port == 0 {
+		return matchIP
+	}
+	return matchNone
+}
+
+func (s *Server) handleAssociate(conn net.Conn, addr *tunnel.Address) {
+	defer conn.Close()
+	// The declared client address, or the control peer's when it is all
+	// zeros or a domain name.
+	assoc := &association{port: addr.Port}
+	if addr.AddressType != tunnel.DomainName && addr.IP != nil && !addr.IP.IsUnspecified() {
+		assoc.ip = addr.IP
+	} else if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		assoc.ip = tcpAddr.IP
+	}
+	assoc.ctx, assoc.cancel = context.WithCancel(s.ctx)
+	defer assoc.cancel()
+
+	s.Lock()
+	s.associations[assoc] = struct{}{}
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.associations, assoc)
+		s.Unlock()
+	}()
+
+	// Reply with the UDP port on the address the client reached us at.
+	relay := &net.UDPAddr{Port: s.udpListener.LocalAddr().(*net.UDPAddr).Port}
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		relay.IP = tcpAddr.IP
+	}
+	if err := reply5(conn, ReplySucceeded, relay); err != nil {
+		s.log.Errorf("socks failed to respond to associate request %v", err.Error())
+		return
+	}
+	go func() {
+		<-assoc.ctx.Done()
+		conn.Close()
+	}()
+	// The association ends when the control connection closes.
+	io.Copy(io.Discard, conn)
+	s.log.Debug("socks udp association ends", conn.RemoteAddr())
+}
+
+// lookupAssociation finds the association a datagram from src belongs to,
+// preferring one declaring its port to one declaring only its IP. Clients
+// behind one NAT may make several that fit equally well, in which case the
+// datagram is refused rather than given to any of them.
+func (s *Server) lookupAssociation(src net.Addr) *association {
+	s.RLock()
+	defer s.RUnlock()
+	var found *association
+	best, ambiguous := matchNone, false
+	for assoc := range s.associations {
+		switch rank := assoc.match(src); {
+		case rank > best:
+			found, best, ambiguous = assoc, rank, false
+		case rank == best && rank != matchNone:
+			ambiguous = true
+		}
+	}
+	if ambiguous {
+		return nil
+	}
+	return found
+}
+
+// newPacketConn starts a UDP session for src that is torn down with its
+// association or after the server timeout without traffic.
+func (s *Server) newPacketConn(src net.Addr, assoc *association) *PacketConn {
+	ctx, cancel := context.WithCancel(assoc.ctx)
+	conn := &PacketConn{
+		in:         make(chan *packetInfo, 16),
+		out:        make(chan *packetInfo, 16),
+		ctx:        ctx,
+		cancel:     cancel,
+		PacketConn: s.udpListener,
+		src:        src,
+	}
+	conn.touch()
+
+	s.Lock()
+	s.mapping[src.String()] = conn
+	timeout := s.timeout
+	s.Unlock()
+
+	go func() {
+		defer func() {
+			conn.Close()
+			s.Lock()
+			if s.mapping[src.String()] == conn {
+				delete(s.mapping, src.String())
+			}
+			s.Unlock()
+		}()
+
+		idle := time.NewTimer(timeout)
+		defer idle.Stop()
+		for {
+			select {
+			case info := <-conn.out:
+				packet := MakeUDPDatagram(info.metadata.Address.Bytes(), info.payload)
+				if _, err := s.udpListener.WriteTo(packet, conn.src); err != nil {
+					s.log.Error("socks failed to respond packet to", src)
+					return
+				}
+				conn.touch()
+				s.log.Debug("socks respond udp packet to", src, "addr", info.metadata)
+			case <-idle.C:
+				if remain := timeout - conn.idle(); remain > 0 {
+					idle.Reset(remain)
+					continue
+				}
+				s.log.Info("socks udp session timeout, closed")
+				return
+			case <-conn.ctx.Done():
+				s.log.Info("socks udp session closed")
+				return
+			}
+		}
+	}()
+	return conn
+}
+
+func (c *PacketConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+func (c *PacketConn) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&c.lastActive))
+}
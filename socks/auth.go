@@ -0,0 +1,101 @@
+package socks
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	MethodNoAuth       byte = 0x00
+	MethodUserPass     byte = 0x02
+	MethodNoAcceptable byte = 0xFF
+
+	userPassVersion byte = 0x01
+	authSuccess     byte = 0x00
+	authFailure     byte = 0x01
+)
+
+var (
+	errNoAcceptableMethod = errors.New("socks no acceptable authentication method")
+	errAuthFailed         = errors.New("socks authentication failed")
+)
+
+// Authenticator verifies the username and password presented by a client.
+type Authenticator interface {
+	Verify(username, password string) bool
+}
+
+// StaticAuthenticator is an Authenticator backed by a username to password map.
+type StaticAuthenticator map[string]string
+
+// Verify compares the password in constant time so its content does not leak
+// through the response timing.
+func (a StaticAuthenticator) Verify(username, password string) bool {
+	p, ok := a[username]
+	return subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 && ok
+}
+
+// selectMethod reads the client's offered methods and answers with the one the
+// server requires, returning the authenticated username if any.
+func (s *Server) selectMethod(rw io.ReadWriter) (user string, err error) {
+	b := make([]byte, 256)
+	if _, err = io.ReadFull(rw, b[:1]); err != nil {
+		return "", fmt.Errorf("failed to read NMETHODS %v", err.Error())
+	}
+	n := b[0]
+	if _, err = io.ReadFull(rw, b[:n]); err != nil {
+		return "", fmt.Errorf("socks failed to read methods %v", err.Error())
+	}
+	method := MethodNoAuth
+	if s.auth != nil {
+		method = MethodUserPass
+	}
+	offered := false
+	for _, m := range b[:n] {
+		if m == method {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		rw.Write([]byte{Version5, MethodNoAcceptable})
+		return "", errNoAcceptableMethod
+	}
+	if _, err = rw.Write([]byte{Version5, method}); err != nil {
+		return "", fmt.Errorf("failed to respond auth %v", err.Error())
+	}
+	if method == MethodUserPass {
+		return s.userPassAuth(rw)
+	}
+	return "", nil
+}
+
+// userPassAuth performs the RFC 1929 username/password sub-negotiation.
+func (s *Server) userPassAuth(rw io.ReadWriter) (string, error) {
+	b := make([]byte, 256)
+	if _, err := io.ReadFull(rw, b[:2]); err != nil {
+		return "", fmt.Errorf("failed to read auth header %v", err.Error())
+	}
+	if b[0] != userPassVersion {
+		return "", fmt.Errorf("unsupported auth version %d", b[0])
+	}
+	ulen := int(b[1])
+	if _, err := io.ReadFull(rw, b[:ulen+1]); err != nil {
+		return "", fmt.Errorf("failed to read username %v", err.Error())
+	}
+	user := string(b[:ulen])
+	plen := int(b[ulen])
+	if _, err := io.ReadFull(rw, b[:plen]); err != nil {
+		return "", fmt.Errorf("failed to read password %v", err.Error())
+	}
+	if !s.auth.Verify(user, string(b[:plen])) {
+		rw.Write([]byte{userPassVersion, authFailure})
+		return "", errAuthFailed
+	}
+	if _, err := rw.Write([]byte{userPassVersion, authSuccess}); err != nil {
+		return "", fmt.Errorf("failed to respond auth status %v", err.Error())
+	}
+	return user, nil
+}
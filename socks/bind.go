@@ -0,0 +1,68 @@
+package socks
+
+import (
+	"errors"
+	"github.com/koomox/goproxy/tunnel"
+	"net"
+	"time"
+)
+
+var (
+	errNotBind     = errors.New("socks connection is not a BIND request")
+	errBindTimeout = errors.New("socks BIND timed out waiting for peer")
+)
+
+// ServeBind serves a BIND request locally. It listens on the server's bind
+// interface, sends the first reply with the listening address, waits for the
+// peer named in the request and sends the second reply with the peer's
+// address. The returned connection should be relayed with c like the result
+// of an outbound dial. Adapters that cannot serve BIND should instead call
+// Reply with ReplyCommandNotSupported and close c.
+func (c *Conn) ServeBind() (net.Conn, error) {
+	if c.metadata.Command != tunnel.Bind {
+		return nil, errNotBind
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(c.bindHost, "0"))
+	if err != nil {
+		c.Reply(ReplyCode(err), nil)
+		return nil, err
+	}
+	defer ln.Close()
+	if err = c.Reply(ReplySucceeded, ln.Addr()); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(c.bindTimeout)
+	ln.(*net.TCPListener).SetDeadline(deadline)
+	for {
+		peer, err := ln.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				reply5(c.Conn, ReplyTTLExpired, nil)
+				return nil, errBindTimeout
+			}
+			reply5(c.Conn, ReplyGeneralFailure, nil)
+			return nil, err
+		}
+		if !c.bindPeerAllowed(peer.RemoteAddr()) {
+			peer.Close()
+			continue
+		}
+		if err = reply5(c.Conn, ReplySucceeded, peer.RemoteAddr()); err != nil {
+			peer.Close()
+			return nil, err
+		}
+		return peer, nil
+	}
+}
+
+// bindPeerAllowed reports whether addr matches DST.ADDR of the request.
+// A domain name or unspecified address accepts any peer.
+func (c *Conn) bindPeerAllowed(addr net.Addr) bool {
+	expect := c.metadata.Address
+	if expect.AddressType == tunnel.DomainName || expect.IP == nil || expect.IP.IsUnspecified() {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.Equal(expect.IP)
+}
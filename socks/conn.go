@@ -5,19 +5,46 @@ import (
 	"errors"
 	"github.com/koomox/goproxy/tunnel"
 	"net"
+	"sync"
+	"time"
 )
 
 type Conn struct {
 	net.Conn
-	metadata *tunnel.Metadata
-	hash     []byte
-	payload  []byte
+	metadata  *tunnel.Metadata
+	hash      []byte
+	user      string
+	payload   []byte
+	reply     func(byte, net.Addr) error
+	replyOnce sync.Once
+
+	bindHost    string
+	bindTimeout time.Duration
+}
+
+// Reply reports the outcome of the upstream dial to the client, using bound
+// as the address the proxy connected from. Only the first call is written;
+// it is a no-op unless the server was set up with SetDeferredReply. On
+// failure the caller should close the connection after replying.
+func (c *Conn) Reply(rep byte, bound net.Addr) (err error) {
+	c.replyOnce.Do(func() {
+		if c.reply != nil {
+			err = c.reply(rep, bound)
+		}
+	})
+	return
 }
 
 func (c *Conn) Hash() string {
 	return string(c.hash)
 }
 
+// User returns the username the client authenticated with, or the
+// USERID field of a SOCKS4 request.
+func (c *Conn) User() string {
+	return c.user
+}
+
 func (c *Conn) Metadata() *tunnel.Metadata {
 	return c.metadata
 }
@@ -32,10 +59,14 @@ type packetInfo struct {
 }
 
 type PacketConn struct {
+	// lastActive is the UnixNano time of the last packet either way,
+	// first in the struct to keep it 64-bit aligned for atomic access.
+	lastActive int64
 	net.PacketConn
 	in     chan *packetInfo
 	out    chan *packetInfo
 	src    net.Addr
+	frag   fragQueue
 	ctx    context.Context
 	cancel context.CancelFunc
 }
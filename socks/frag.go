@@ -0,0 +1,74 @@
+package socks
+
+import "time"
+
+const (
+	fragEnd          byte = 0x80
+	fragMinTimeout        = 5 * time.Second
+	maxFragQueueLen       = 127
+	maxFragQueueSize      = UdpBufSize
+)
+
+// fragQueue reassembles the fragment sequence of one UDP client
+// (RFC 1928 section 7). FRAG holds the fragment position in its low seven
+// bits, and the high bit marks the last fragment of a sequence.
+type fragQueue struct {
+	addr      []byte
+	fragments [][]byte
+	highest   byte
+	size      int
+	deadline  time.Time
+}
+
+func (q *fragQueue) reset() {
+	q.addr = nil
+	q.fragments = nil
+	q.highest = 0
+	q.size = 0
+}
+
+// push queues one fragment. Once the last fragment arrives it returns the
+// destination address and payload of the reassembled datagram, or drops the
+// sequence if a fragment is missing.
+func (q *fragQueue) push(frag byte, addr, payload []byte, now time.Time, timeout time.Duration) ([]byte, []byte, bool) {
+	pos := frag &^ fragEnd
+	if pos == 0 {
+		return nil, nil, false
+	}
+	// The queue and timer are reinitialized when the timer expires or a
+	// fragment arrives with a position lower than the highest seen so far.
+	if now.After(q.deadline) || pos < q.highest {
+		q.reset()
+	}
+	if q.highest == 0 {
+		q.deadline = now.Add(timeout)
+	}
+	if pos == q.highest {
+		return nil, nil, false // duplicate
+	}
+	if len(q.fragments) == maxFragQueueLen || q.size+len(payload) > maxFragQueueSize {
+		q.reset()
+		return nil, nil, false
+	}
+	if pos == 1 {
+		q.addr = addr
+	}
+	q.fragments = append(q.fragments, payload)
+	q.size += len(payload)
+	q.highest = pos
+	if frag&fragEnd == 0 {
+		return nil, nil, false
+	}
+
+	defer q.reset()
+	// Positions only ever increase, so the sequence is complete when every
+	// position up to the last one has been queued.
+	if q.addr == nil || len(q.fragments) != int(pos) {
+		return nil, nil, false
+	}
+	b := make([]byte, 0, q.size)
+	for _, f := range q.fragments {
+		b = append(b, f...)
+	}
+	return q.addr, b, true
+}
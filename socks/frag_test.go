@@ -0,0 +1,125 @@
+package socks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFragQueue(t *testing.T) {
+	addr := ParseAddr("1.2.3.4:53")
+	type fragment struct {
+		frag  byte
+		data  string
+		after time.Duration
+	}
+	tests := []struct {
+		name      string
+		fragments []fragment
+		want      string
+	}{
+		{
+			name:      "in order",
+			fragments: []fragment{{1, "hel", 0}, {2, "lo ", 0}, {3 | fragEnd, "world", 0}},
+			want:      "hello world",
+		},
+		{
+			name:      "single end fragment",
+			fragments: []fragment{{1 | fragEnd, "hello", 0}},
+			want:      "hello",
+		},
+		{
+			name:      "out of order resets queue",
+			fragments: []fragment{{1, "hel", 0}, {3, "wor", 0}, {2, "lo ", 0}, {3 | fragEnd, "ld", 0}},
+		},
+		{
+			name:      "missing fragment",
+			fragments: []fragment{{1, "hel", 0}, {3 | fragEnd, "ld", 0}},
+		},
+		{
+			name:      "duplicate fragment",
+			fragments: []fragment{{1, "hel", 0}, {1, "hel", 0}, {2 | fragEnd, "lo", 0}},
+			want:      "hello",
+		},
+		{
+			name:      "expired",
+			fragments: []fragment{{1, "hel", 0}, {2 | fragEnd, "lo", 6 * time.Second}},
+		},
+		{
+			name:      "new sequence after expiry",
+			fragments: []fragment{{1, "old", 0}, {1, "hel", 6 * time.Second}, {2 | fragEnd, "lo", 0}},
+			want:      "hello",
+		},
+		{
+			name:      "invalid position",
+			fragments: []fragment{{fragEnd, "hello", 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &fragQueue{}
+			now := time.Now()
+			var got []string
+			for _, f := range tt.fragments {
+				now = now.Add(f.after)
+				if a, p, ok := q.push(f.frag, addr, []byte(f.data), now, fragMinTimeout); ok {
+					if !bytes.Equal(a, addr) {
+						t.Errorf("got addr %x, want %x", a, addr)
+					}
+					got = append(got, string(p))
+				}
+			}
+			switch {
+			case tt.want == "" && len(got) != 0:
+				t.Errorf("got %q, want nothing", got)
+			case tt.want != "" && (len(got) != 1 || got[0] != tt.want):
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPacketFragments(t *testing.T) {
+	tests := []struct {
+		name       string
+		reassembly bool
+		want       string
+	}{
+		{"reassembly", true, "hello world"},
+		{"disabled", false, "whole"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.SetFragReassembly(tt.reassembly, 0)
+			client, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			associateTestClient(t, s, client.LocalAddr())
+
+			addr := ParseAddr("1.2.3.4:53")
+			for _, packet := range [][]byte{
+				append([]byte{0, 0, 1}, append(addr, "hello "...)...),
+				append([]byte{0, 0, 2 | fragEnd}, append(addr, "world"...)...),
+				MakeUDPDatagram(addr, []byte("whole")),
+			} {
+				client.WriteTo(packet, s.udpListener.LocalAddr())
+			}
+			pc, err := s.AcceptPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, MaxPacketSize)
+			n, m, err := pc.ReadWithMetadata(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != tt.want || m.String() != "1.2.3.4:53" {
+				t.Errorf("got %q from %v, want %q", buf[:n], m, tt.want)
+			}
+		})
+	}
+}
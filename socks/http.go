@@ -3,32 +3,86 @@ package socks
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
+	"errors"
 	"github.com/koomox/goproxy/tunnel"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"strings"
 )
 
 var (
-	httpStatusOK = []byte("HTTP/1.0 200 Connection Established\r\n\r\n")
+	httpStatusOK                = []byte("HTTP/1.0 200 Connection Established\r\n\r\n")
+	httpStatusProxyAuthRequired = []byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"goproxy\"\r\nContent-Length: 0\r\n\r\n")
+
+	errProxyAuthRequired = errors.New("http proxy authentication required")
 )
 
 // local socks server  connect
 func HttpOnceAccept(first byte, conn net.Conn) (addr *tunnel.Address, payload []byte, err error) {
-	var (
-		host string
-		port string
-	)
+	addr, payload, _, err = HttpOnceAcceptWithAuth(first, conn, nil)
+	return
+}
+
+// HttpOnceAcceptWithAuth is HttpOnceAccept with a Proxy-Authorization Basic
+// check. A nil auth accepts every request.
+func HttpOnceAcceptWithAuth(first byte, conn net.Conn, auth Authenticator) (addr *tunnel.Address, payload []byte, user string, err error) {
+	var connect bool
+	var metadata *tunnel.Metadata
+	if metadata, payload, user, connect, err = httpAccept(first, conn, auth); err != nil {
+		return
+	}
+	addr = metadata.Address
+	if connect {
+		_, err = conn.Write(httpStatusOK)
+	}
+	return
+}
 
-	buf := make([]byte, 4096)
-	buf[0] = first
-	io.ReadAtLeast(conn, buf[1:], 1)
-	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf)))
+// httpAccept parses the first request on conn without answering it, so that
+// the caller can report the outcome of the upstream dial.
+func httpAccept(first byte, conn net.Conn, auth Authenticator) (metadata *tunnel.Metadata, payload []byte, user string, connect bool, err error) {
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader([]byte{first}), conn))
+	req, err := http.ReadRequest(r)
 	if nil != err {
 		return
 	}
-	host, port, err = net.SplitHostPort(req.Host)
+	if auth != nil {
+		var ok bool
+		if user, ok = proxyAuth(req, auth); !ok {
+			conn.Write(httpStatusProxyAuthRequired)
+			return nil, nil, "", false, errProxyAuthRequired
+		}
+	}
+	addr, err := requestAddr(req)
+	if err != nil {
+		return
+	}
+	metadata = &tunnel.Metadata{Command: Connect, Address: addr, HTTP: requestInfo(req)}
+	method := req.Method
+	switch method {
+	case http.MethodConnect:
+		connect = true
+	default:
+		removeHeaders(req)
+		if payload, err = httputil.DumpRequest(req, true); err != nil {
+			return
+		}
+	}
+	// Anything the client sent after the request travels with it.
+	if n := r.Buffered(); n > 0 {
+		rest, _ := r.Peek(n)
+		payload = append(payload, rest...)
+	}
+	return
+}
+
+// requestAddr returns the target of a proxy request, defaulting the port
+// from the URL scheme.
+func requestAddr(req *http.Request) (*tunnel.Address, error) {
+	host, port, err := net.SplitHostPort(req.Host)
 	if nil != err {
 		host = req.Host
 		port = req.URL.Port()
@@ -41,34 +95,69 @@ func HttpOnceAccept(first byte, conn net.Conn) (addr *tunnel.Address, payload []
 			port = "443"
 		}
 	}
-	if addr, err = tunnel.ResolveAddr("tcp", net.JoinHostPort(host, port)); err != nil {
-		return
+	return tunnel.ResolveAddr("tcp", net.JoinHostPort(host, port))
+}
+
+// requestInfo captures the request attributes rules can match on.
+func requestInfo(req *http.Request) *tunnel.HTTPRequest {
+	return &tunnel.HTTPRequest{
+		UserAgent: req.Header.Get("User-Agent"),
+		Host:      req.Host,
+		Method:    req.Method,
+		Path:      req.URL.Path,
 	}
-	method := req.Method
-	switch method {
-	case http.MethodConnect:
-		_, err = conn.Write(httpStatusOK)
-	default:
-		removeHeaders(req)
-		payload, err = httputil.DumpRequest(req, true)
+}
+
+// proxyAuth checks the Basic credentials in the Proxy-Authorization header.
+func proxyAuth(req *http.Request, auth Authenticator) (string, bool) {
+	const prefix = "Basic "
+	h := req.Header.Get("Proxy-Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
 	}
-	return
+	b, err := base64.StdEncoding.DecodeString(h[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	user, password, ok := strings.Cut(string(b), ":")
+	if !ok || !auth.Verify(user, password) {
+		return "", false
+	}
+	return user, true
 }
 
 func removeHeaders(req *http.Request) {
 	req.RequestURI = ""
 	req.Header.Del("Accept-Encoding")
-	// curl can add that, see
-	// https://jdebp.eu./FGA/web-proxy-connection-header.html
-	req.Header.Del("Proxy-Connection")
-	req.Header.Del("Proxy-Authenticate")
-	req.Header.Del("Proxy-Authorization")
 	//req.Header.Del("Referer")
-	// Connection, Authenticate and Authorization are single hop Header:
-	// http://www.w3.org/Protocols/rfc2616/rfc2616.txt
-	// 14.10 Connection
-	//   The Connection general-header field allows the sender to specify
-	//   options that are desired for that particular connection and MUST NOT
-	//   be communicated by proxies over further connections.
-	req.Header.Del("Connection")
+	removeHopHeaders(req.Header)
+}
+
+// Hop-by-hop headers, plus Proxy-Connection which curl can add, see
+// https://jdebp.eu./FGA/web-proxy-connection-header.html
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders strips the headers that only apply to a single hop,
+// including any listed in Connection (RFC 7230 section 6.1).
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
 }
@@ -0,0 +1,232 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/koomox/goproxy/tunnel"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var httpStatusContinue = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// HttpDialer opens the upstream connection for a proxied HTTP request,
+// typically by matching the metadata against the rule engine.
+type HttpDialer interface {
+	Dial(user string, metadata *tunnel.Metadata) (net.Conn, error)
+}
+
+// AddHttpDialer switches the HTTP listener to a full HTTP/1.1 forward proxy.
+// Every request on a keep-alive connection is parsed and forwarded on its
+// own, and dialer is asked for a new upstream whenever the target of a
+// request changes. CONNECT requests are still handed to AcceptConn.
+func (s *Server) AddHttpDialer(dialer HttpDialer) {
+	s.httpDialer = dialer
+}
+
+type httpSession struct {
+	*Server
+	conn           net.Conn
+	reader         *bufio.Reader
+	upstream       net.Conn
+	upstreamReader *bufio.Reader
+	upstreamAddr   string
+}
+
+func (s *Server) serveHttp(first byte, conn net.Conn) {
+	hs := &httpSession{
+		Server: s,
+		conn:   conn,
+		reader: bufio.NewReader(io.MultiReader(bytes.NewReader([]byte{first}), conn)),
+	}
+	defer hs.closeUpstream()
+	for {
+		req, err := http.ReadRequest(hs.reader)
+		if err != nil {
+			if err != io.EOF {
+				s.log.Errorf("failed to read http request %v", err.Error())
+			}
+			conn.Close()
+			return
+		}
+		if req.Method == http.MethodConnect {
+			hs.connect(req)
+			return
+		}
+		if !hs.forward(req) {
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (hs *httpSession) authenticate(req *http.Request) (string, bool) {
+	if hs.auth == nil {
+		return "", true
+	}
+	user, ok := proxyAuth(req, hs.auth)
+	if !ok {
+		hs.conn.Write(httpStatusProxyAuthRequired)
+	}
+	return user, ok
+}
+
+// connect hands a CONNECT tunnel over to AcceptConn.
+func (hs *httpSession) connect(req *http.Request) {
+	user, ok := hs.authenticate(req)
+	if !ok {
+		hs.conn.Close()
+		return
+	}
+	addr, err := requestAddr(req)
+	if err != nil {
+		hs.log.Errorf("failed to http connection %v", err.Error())
+		hs.conn.Close()
+		return
+	}
+	hs.closeUpstream()
+	var payload []byte
+	if n := hs.reader.Buffered(); n > 0 {
+		payload, _ = hs.reader.Peek(n)
+	}
+	conn := hs.conn
+	metadata := &tunnel.Metadata{Command: Connect, Address: addr, HTTP: requestInfo(req)}
+	hs.reverseFakeIP(metadata)
+	c := &Conn{Conn: conn, metadata: metadata, user: user, payload: payload}
+	c.reply = func(rep byte, _ net.Addr) error { return replyHttp(conn, rep, true) }
+	if !hs.deferReply {
+		if err = c.Reply(ReplySucceeded, nil); err != nil {
+			hs.log.Errorf("failed to respond http connection %v", err.Error())
+			conn.Close()
+			return
+		}
+	}
+	hs.log.Debug("http connect", user, addr)
+	hs.connChan <- c
+}
+
+// forward relays one request and its response, and reports whether the
+// client connection can be kept alive.
+func (hs *httpSession) forward(req *http.Request) bool {
+	user, ok := hs.authenticate(req)
+	if !ok {
+		// The client may still be sending a body we do not want.
+		return req.ContentLength == 0 && !expectContinue(req)
+	}
+	addr, err := requestAddr(req)
+	if err != nil {
+		hs.log.Errorf("failed to http request %v", err.Error())
+		replyHttp(hs.conn, ReplyAddrTypeNotSupported, false)
+		return false
+	}
+	metadata := &tunnel.Metadata{Command: Connect, Address: addr, HTTP: requestInfo(req)}
+	hs.reverseFakeIP(metadata)
+	addr = metadata.Address
+	keepAlive := !req.Close && !strings.EqualFold(req.Header.Get("Proxy-Connection"), "close")
+
+	reused := hs.upstream != nil && hs.upstreamAddr == addr.String()
+	if !reused {
+		if err = hs.dialUpstream(user, metadata); err != nil {
+			return false
+		}
+	}
+	hs.log.Debug("http request", user, req.Method, req.URL)
+
+	if expectContinue(req) {
+		req.Header.Del("Expect")
+		req.Body = &expectContinueReader{ReadCloser: req.Body, w: hs.conn}
+	}
+	removeHopHeaders(req.Header)
+	req.RequestURI = ""
+	resp, err := hs.roundTrip(req)
+	if err != nil && reused && replayable(req) {
+		// The origin may have closed the idle connection.
+		hs.log.Debug("http upstream closed, retrying", addr)
+		if err = hs.dialUpstream(user, metadata); err != nil {
+			return false
+		}
+		resp, err = hs.roundTrip(req)
+	}
+	if err != nil {
+		hs.log.Errorf("failed to http request %v", err.Error())
+		hs.closeUpstream()
+		replyHttp(hs.conn, ReplyCode(err), false)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.Close {
+		defer hs.closeUpstream()
+	}
+	removeHopHeaders(resp.Header)
+	resp.Close = resp.Close || !keepAlive
+	if err = resp.Write(hs.conn); err != nil {
+		hs.log.Errorf("failed to write http response %v", err.Error())
+		return false
+	}
+	return !resp.Close
+}
+
+// dialUpstream replaces the upstream connection by a new one to the target
+// of metadata, replying to the client if the dial fails.
+func (hs *httpSession) dialUpstream(user string, metadata *tunnel.Metadata) error {
+	hs.closeUpstream()
+	rc, err := hs.httpDialer.Dial(user, metadata)
+	if err != nil {
+		hs.log.Errorf("failed to dial http upstream %v %v", metadata, err.Error())
+		replyHttp(hs.conn, ReplyCode(err), false)
+		return err
+	}
+	hs.upstream, hs.upstreamReader, hs.upstreamAddr = rc, bufio.NewReader(rc), metadata.Address.String()
+	return nil
+}
+
+// roundTrip writes req to the upstream connection and reads the response.
+func (hs *httpSession) roundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Write(hs.upstream); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(hs.upstreamReader, req)
+}
+
+// replayable reports whether req can be sent again after a failure: it is
+// idempotent and has no body that was consumed by the first attempt.
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.ContentLength == 0 && len(req.TransferEncoding) == 0
+	}
+	return false
+}
+
+func (hs *httpSession) closeUpstream() {
+	if hs.upstream != nil {
+		hs.upstream.Close()
+		hs.upstream, hs.upstreamReader, hs.upstreamAddr = nil, nil, ""
+	}
+}
+
+func expectContinue(req *http.Request) bool {
+	return req.ProtoAtLeast(1, 1) && strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
+// expectContinueReader sends 100 Continue to the client the first time the
+// request body is read, which is when the upstream is ready for it.
+type expectContinueReader struct {
+	io.ReadCloser
+	w    io.Writer
+	once sync.Once
+	err  error
+}
+
+func (r *expectContinueReader) Read(b []byte) (int, error) {
+	r.once.Do(func() {
+		_, r.err = r.w.Write(httpStatusContinue)
+	})
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.ReadCloser.Read(b)
+}
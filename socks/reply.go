@@ -0,0 +1,103 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"github.com/koomox/goproxy/tunnel"
+	"io"
+	"net"
+	"syscall"
+)
+
+// SOCKS5 reply codes (RFC 1928 section 6)
+const (
+	ReplySucceeded            byte = 0x00
+	ReplyGeneralFailure       byte = 0x01
+	ReplyNotAllowed           byte = 0x02
+	ReplyNetworkUnreachable   byte = 0x03
+	ReplyHostUnreachable      byte = 0x04
+	ReplyConnectionRefused    byte = 0x05
+	ReplyTTLExpired           byte = 0x06
+	ReplyCommandNotSupported  byte = 0x07
+	ReplyAddrTypeNotSupported byte = 0x08
+)
+
+// ErrNotAllowed can be returned by dialers to report that the ruleset
+// rejected the connection.
+var ErrNotAllowed = errors.New("connection not allowed by ruleset")
+
+var (
+	httpStatusForbidden      = []byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	httpStatusBadGateway     = []byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	httpStatusGatewayTimeout = []byte("HTTP/1.1 504 Gateway Timeout\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+)
+
+// ReplyCode maps the error of an upstream dial to a SOCKS5 reply code.
+func ReplyCode(err error) byte {
+	if err == nil {
+		return ReplySucceeded
+	}
+	if errors.Is(err, ErrNotAllowed) {
+		return ReplyNotAllowed
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ReplyHostUnreachable
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ReplyHostUnreachable
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ReplyTTLExpired
+	}
+	return ReplyGeneralFailure
+}
+
+// reply5 writes a SOCKS5 reply with bound as BND.ADDR and BND.PORT,
+// or 0.0.0.0:0 when bound is nil.
+func reply5(w io.Writer, rep byte, bound net.Addr) (err error) {
+	addr := &tunnel.Address{AddressType: tunnel.IPv4, IP: net.IPv4zero}
+	if bound != nil {
+		if addr, err = tunnel.ResolveAddr("tcp", bound.String()); err != nil {
+			return
+		}
+	}
+	buf := bytes.NewBuffer([]byte{Version5, rep, 0x00})
+	if err = addr.WriteTo(buf); err != nil {
+		return
+	}
+	_, err = w.Write(buf.Bytes())
+	return
+}
+
+func reply4(w io.Writer, rep byte) (err error) {
+	code := socks4Granted
+	if rep != ReplySucceeded {
+		code = socks4Rejected
+	}
+	_, err = w.Write([]byte{0x00, code, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	return
+}
+
+// replyHttp answers a CONNECT request with 200 on success. Plain requests
+// are forwarded as they are, so only failures are written.
+func replyHttp(w io.Writer, rep byte, connect bool) (err error) {
+	switch rep {
+	case ReplySucceeded:
+		if connect {
+			_, err = w.Write(httpStatusOK)
+		}
+	case ReplyNotAllowed:
+		_, err = w.Write(httpStatusForbidden)
+	case ReplyTTLExpired:
+		_, err = w.Write(httpStatusGatewayTimeout)
+	default:
+		_, err = w.Write(httpStatusBadGateway)
+	}
+	return
+}
@@ -1,7 +1,6 @@
 package socks
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -15,6 +14,7 @@ import (
 
 const (
 	Connect   byte = 0x01
+	Bind      byte = 0x02
 	Associate byte = 0x03
 
 	MaxPacketSize = 8 * 1024
@@ -22,15 +22,23 @@ const (
 
 type Server struct {
 	sync.RWMutex
-	tcpListener net.Listener
-	udpListener net.PacketConn
-	timeout     time.Duration
-	connChan    chan tunnel.Conn
-	packetChan  chan tunnel.PacketConn
-	mapping     map[string]*PacketConn
-	log         goproxy.Logger
-	ctx         context.Context
-	cancel      context.CancelFunc
+	tcpListener  net.Listener
+	udpListener  net.PacketConn
+	timeout      time.Duration
+	connChan     chan tunnel.Conn
+	packetChan   chan tunnel.PacketConn
+	mapping      map[string]*PacketConn
+	associations map[*association]struct{}
+	auth         Authenticator
+	deferReply   bool
+	bindHost     string
+	httpDialer   HttpDialer
+	reassembly   bool
+	fragTimeout  time.Duration
+	fakeIP       tunnel.FakeIP
+	log          goproxy.Logger
+	ctx          context.Context
+	cancel       context.CancelFunc
 }
 
 func (s *Server) Close() error {
@@ -52,15 +60,18 @@ func NewServer(addr string, ctx context.Context, log goproxy.Logger) (*Server, e
 		return nil, fmt.Errorf("failed to create udp listener %v", err.Error())
 	}
 	s := &Server{
-		tcpListener: tcpListener,
-		udpListener: udpListener,
-		timeout:     time.Duration(60) * time.Second,
-		connChan:    make(chan tunnel.Conn, 32),
-		packetChan:  make(chan tunnel.PacketConn, 32),
-		mapping:     make(map[string]*PacketConn),
-		log:         log,
-		ctx:         ctx,
-		cancel:      cancel,
+		tcpListener:  tcpListener,
+		udpListener:  udpListener,
+		timeout:      time.Duration(60) * time.Second,
+		connChan:     make(chan tunnel.Conn, 32),
+		packetChan:   make(chan tunnel.PacketConn, 32),
+		mapping:      make(map[string]*PacketConn),
+		associations: make(map[*association]struct{}),
+		reassembly:   true,
+		fragTimeout:  fragMinTimeout,
+		log:          log,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 	log.Info("listening start tcp/udp ", addr)
 	go s.acceptConnLoop()
@@ -68,6 +79,62 @@ func NewServer(addr string, ctx context.Context, log goproxy.Logger) (*Server, e
 	return s, nil
 }
 
+// SetAuthenticator requires clients to authenticate with a username and
+// password, using RFC 1929 for SOCKS5 and Proxy-Authorization for HTTP. It
+// replaces any authenticator set before.
+func (s *Server) SetAuthenticator(auth Authenticator) {
+	s.auth = auth
+}
+
+// SetDeferredReply makes the server hold back the reply to CONNECT requests
+// until the consumer of AcceptConn calls Conn.Reply with the dial outcome.
+func (s *Server) SetDeferredReply(deferReply bool) {
+	s.deferReply = deferReply
+}
+
+// SetBindInterface sets the host BIND listeners are opened on. By default
+// they listen on the address the client connected to.
+func (s *Server) SetBindInterface(host string) {
+	s.bindHost = host
+}
+
+// SetTimeout sets how long UDP sessions and BIND listeners wait without
+// traffic before they are closed.
+func (s *Server) SetTimeout(timeout time.Duration) {
+	s.Lock()
+	s.timeout = timeout
+	s.Unlock()
+}
+
+// SetFragReassembly enables or disables reassembly of fragmented SOCKS5 UDP
+// datagrams. timeout is the reassembly timer, no less than 5 seconds. When
+// disabled, fragments are dropped.
+func (s *Server) SetFragReassembly(enable bool, timeout time.Duration) {
+	if timeout < fragMinTimeout {
+		timeout = fragMinTimeout
+	}
+	s.Lock()
+	s.reassembly = enable
+	s.fragTimeout = timeout
+	s.Unlock()
+}
+
+// SetFakeIP makes the server reverse destinations handed out by a fake-IP
+// DNS, such as dns.FakeIPPool, to the domains they stand for.
+func (s *Server) SetFakeIP(f tunnel.FakeIP) {
+	s.Lock()
+	s.fakeIP = f
+	s.Unlock()
+}
+
+// reverseFakeIP replaces a fake IP destination of m by its domain.
+func (s *Server) reverseFakeIP(m *tunnel.Metadata) {
+	s.RLock()
+	f := s.fakeIP
+	s.RUnlock()
+	m.ReverseFakeIP(f)
+}
+
 func (s *Server) acceptConnLoop() {
 	for {
 		conn, err := s.tcpListener.Accept()
@@ -86,58 +153,103 @@ func (s *Server) acceptConnLoop() {
 		}
 		go func(conn net.Conn) {
 			b := [1]byte{}
-			if _, err = io.ReadFull(conn, b[:]); err != nil {
+			if _, err := io.ReadFull(conn, b[:]); err != nil {
 				s.log.Errorf("failed to read socks first char %v", err.Error())
 				conn.Close()
 				return
 			}
-			if b[0] == Version5 {
+			switch b[0] {
+			case Version5:
 				s.log.Debug("socks5 connection")
-				cmd, addr, err := s.handshake(conn)
-				if err != nil {
-					conn.Close()
-					s.log.Errorf("socks failed to handshake with client %v", err.Error())
-					return
-				}
-				switch cmd {
-				case Connect:
-					if err = s.connect(conn); err != nil {
-						s.log.Errorf("socks failed to respond CONNECT %v", err.Error())
-						conn.Close()
-						return
-					}
-					s.connChan <- &Conn{Conn: conn, metadata: &tunnel.Metadata{Command: Connect, Address: addr}, payload: nil}
-				case Associate:
-					defer conn.Close()
-					laddr, err := tunnel.ResolveAddr("udp", conn.LocalAddr().String())
-					if err != nil {
-						return
-					}
-					if err = s.associate(conn, laddr); err != nil {
-						s.log.Errorf("socks failed to respond to associate request %v", err.Error())
-						return
-					}
-					buf := [16]byte{}
-					conn.Read(buf[:])
-					s.log.Debug("socks udp session ends")
-				default:
-					s.log.Errorf("unknown socks command %d", cmd)
-					conn.Close()
-				}
-			} else {
+				s.handleSocks5(conn)
+			case Version4:
+				s.log.Debug("socks4 connection")
+				s.handleSocks4(conn)
+			default:
 				s.log.Debug("http connection")
-				addr, payload, err := HttpOnceAccept(b[0], conn)
-				if err != nil {
-					s.log.Errorf("failed to http connection %v", err.Error())
-					conn.Close()
-					return
-				}
-				s.connChan <- &Conn{Conn: conn, metadata: &tunnel.Metadata{Command: Connect, Address: addr}, payload: payload}
+				s.handleHttp(b[0], conn)
 			}
 		}(conn)
 	}
 }
 
+func (s *Server) handleSocks5(conn net.Conn) {
+	cmd, user, addr, err := s.handshake(conn)
+	if err != nil {
+		conn.Close()
+		s.log.Errorf("socks failed to handshake with client %v", err.Error())
+		return
+	}
+	switch cmd {
+	case Connect:
+		metadata := &tunnel.Metadata{Command: Connect, Address: addr}
+		// Clients of a fake-IP DNS connect to addresses standing for domains.
+		s.reverseFakeIP(metadata)
+		c := &Conn{Conn: conn, metadata: metadata, user: user, payload: nil}
+		c.reply = func(rep byte, bound net.Addr) error { return reply5(conn, rep, bound) }
+		if !s.deferReply {
+			if err = c.Reply(ReplySucceeded, nil); err != nil {
+				s.log.Errorf("socks failed to respond CONNECT %v", err.Error())
+				conn.Close()
+				return
+			}
+		}
+		s.log.Debug("socks5 connect", user, addr)
+		s.connChan <- c
+	case Bind:
+		// BIND needs the consumer to either serve it or refuse it.
+		if !s.deferReply {
+			s.log.Errorf("socks BIND requires deferred reply")
+			reply5(conn, ReplyCommandNotSupported, nil)
+			conn.Close()
+			return
+		}
+		c := &Conn{Conn: conn, metadata: &tunnel.Metadata{Command: tunnel.Bind, Address: addr}, user: user, payload: nil}
+		c.reply = func(rep byte, bound net.Addr) error { return reply5(conn, rep, bound) }
+		c.bindHost = s.bindHost
+		if c.bindHost == "" {
+			c.bindHost, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+		}
+		s.RLock()
+		c.bindTimeout = s.timeout
+		s.RUnlock()
+		s.log.Debug("socks5 bind", user, addr)
+		s.connChan <- c
+	case Associate:
+		s.log.Debug("socks5 associate", user, addr)
+		s.handleAssociate(conn, addr)
+	default:
+		s.log.Errorf("unknown socks command %d", cmd)
+		reply5(conn, ReplyCommandNotSupported, nil)
+		conn.Close()
+	}
+}
+
+func (s *Server) handleHttp(first byte, conn net.Conn) {
+	if s.httpDialer != nil {
+		s.serveHttp(first, conn)
+		return
+	}
+	metadata, payload, user, connect, err := httpAccept(first, conn, s.auth)
+	if err != nil {
+		s.log.Errorf("failed to http connection %v", err.Error())
+		conn.Close()
+		return
+	}
+	s.reverseFakeIP(metadata)
+	c := &Conn{Conn: conn, metadata: metadata, user: user, payload: payload}
+	c.reply = func(rep byte, _ net.Addr) error { return replyHttp(conn, rep, connect) }
+	if !s.deferReply {
+		if err = c.Reply(ReplySucceeded, nil); err != nil {
+			s.log.Errorf("failed to respond http connection %v", err.Error())
+			conn.Close()
+			return
+		}
+	}
+	s.log.Debug("http connect", user, metadata)
+	s.connChan <- c
+}
+
 func (s *Server) Dial(payload []byte, addr string) (conn net.Conn, err error) {
 	if conn, err = net.Dial("tcp", addr); err != nil {
 		return
@@ -166,40 +278,19 @@ func (s *Server) AcceptPacket() (tunnel.PacketConn, error) {
 	}
 }
 
-func (s *Server) handshake(rw io.ReadWriter) (cmd byte, addr *tunnel.Address, err error) {
-	b := make([]byte, 256)
-	if _, err = rw.Read(b[:1]); err != nil {
-		return 0, nil, fmt.Errorf("failed to read NMETHODS %v", err.Error())
-	}
-	n := b[0]
-	if _, err = io.ReadFull(rw, b[:n]); err != nil {
-		return 0, nil, fmt.Errorf("socks failed to read methods %v", err.Error())
-	}
-	if _, err = rw.Write([]byte{0x05, 0x00}); err != nil {
-		return 0, nil, fmt.Errorf("failed to respond auth %v", err.Error())
+func (s *Server) handshake(rw io.ReadWriter) (cmd byte, user string, addr *tunnel.Address, err error) {
+	if user, err = s.selectMethod(rw); err != nil {
+		return 0, "", nil, err
 	}
-	if _, err = rw.Read(b[:3]); err != nil {
-		return 0, nil, fmt.Errorf("failed to read command %v", err.Error())
+	b := [3]byte{}
+	if _, err = io.ReadFull(rw, b[:]); err != nil {
+		return 0, "", nil, fmt.Errorf("failed to read command %v", err.Error())
 	}
 	addr = &tunnel.Address{}
 	if err = addr.ReadFrom(rw); err != nil {
-		return 0, nil, err
+		return 0, "", nil, err
 	}
-	return b[1], addr, nil
-}
-
-func (s *Server) connect(w io.Writer) (err error) {
-	_, err = w.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-	return err
-}
-
-func (s *Server) associate(w io.Writer, addr *tunnel.Address) (err error) {
-	buf := bytes.NewBuffer([]byte{0x05, 0x00, 0x00})
-	if err = addr.WriteTo(buf); err != nil {
-		return
-	}
-	_, err = w.Write(buf.Bytes())
-	return
+	return b[1], user, addr, nil
 }
 
 func (s *Server) packetDispatchLoop() {
@@ -220,69 +311,46 @@ func (s *Server) packetDispatchLoop() {
 			}
 		}
 		s.log.Debug("socks recv udp packet from", src)
-		if n < 10 {
-			return
+		frag, rawAddr, payload, err := SplitUDPDatagram(b[:n])
+		if err != nil {
+			s.log.Errorf("socks failed to parse incoming packet %v", err.Error())
+			continue
 		}
 		s.RLock()
+		reassembly, fragTimeout := s.reassembly, s.fragTimeout
 		conn, found := s.mapping[src.String()]
 		s.RUnlock()
+		if frag != 0 && !reassembly {
+			s.log.Debug("socks drop udp fragment from", src)
+			continue
+		}
 		if !found {
-			ctx, cancel := context.WithCancel(s.ctx)
-			conn = &PacketConn{
-				in:         make(chan *packetInfo, 16),
-				out:        make(chan *packetInfo, 16),
-				ctx:        ctx,
-				cancel:     cancel,
-				PacketConn: s.udpListener,
-				src:        src,
+			assoc := s.lookupAssociation(src)
+			if assoc == nil {
+				s.log.Debug("socks drop udp packet without association from", src)
+				continue
 			}
-			go func(conn *PacketConn) {
-				defer conn.Close()
-
-				for {
-					select {
-					case info := <-conn.out:
-						buf := bytes.NewBuffer(make([]byte, 0, MaxPacketSize))
-						buf.Write([]byte{0, 0, 0})
-						if err := info.metadata.Address.WriteTo(buf); err != nil {
-							return
-						}
-						buf.Write(info.payload)
-						if _, err := s.udpListener.WriteTo(buf.Bytes(), conn.src); err != nil {
-							s.log.Error("socks failed to respond packet to", src)
-							return
-						}
-						s.log.Debug("socks respond udp packet to", src, "addr", info.metadata)
-					case <-time.After(time.Second * 5):
-						s.log.Info("socks udp session timeout, closed")
-						s.Lock()
-						delete(s.mapping, src.String())
-						s.Unlock()
-						return
-					case <-conn.ctx.Done():
-						s.log.Info("socks udp session closed")
-						return
-					}
-				}
-			}(conn)
-
-			s.Lock()
-			s.mapping[src.String()] = conn
-			s.Unlock()
-
+			conn = s.newPacketConn(src, assoc)
 			s.packetChan <- conn
 			s.log.Info("socks new udp session from", src)
 		}
-		r := bytes.NewBuffer(b[3:n])
-		addr := &tunnel.Address{}
-		if err := addr.ReadFrom(r); err != nil {
+		if frag != 0 {
+			var complete bool
+			if rawAddr, payload, complete = conn.frag.push(frag, rawAddr, payload, time.Now(), fragTimeout); !complete {
+				continue
+			}
+		}
+		addr, err := tunnel.SplitAddr(rawAddr)
+		if err != nil {
 			s.log.Errorf("socks failed to parse incoming packet %v", err.Error())
 			continue
 		}
-		payload := make([]byte, MaxPacketSize)
-		length, _ := r.Read(payload)
+		addr.NetworkType = "udp"
+		metadata := &tunnel.Metadata{Address: addr}
+		s.reverseFakeIP(metadata)
+		conn.touch()
 		select {
-		case conn.in <- &packetInfo{metadata: &tunnel.Metadata{Address: addr}, payload: payload[:length]}:
+		case conn.in <- &packetInfo{metadata: metadata, payload: payload}:
 		default:
 			s.log.Info("socks udp queue full")
 		}
@@ -0,0 +1,692 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koomox/goproxy/tunnel"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Info(...interface{})           {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Error(...interface{})          {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+func (nopLogger) Debug(...interface{})          {}
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := NewServer("127.0.0.1:0", context.Background(), nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dialTestServer(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func expectBytes(t *testing.T, r io.Reader, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+func acceptTestConn(t *testing.T, s *Server) *Conn {
+	t.Helper()
+	ch := make(chan *Conn, 1)
+	go func() {
+		conn, err := s.AcceptConn()
+		if err == nil {
+			ch <- conn.(*Conn)
+		}
+	}()
+	select {
+	case conn := <-ch:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for connection")
+		return nil
+	}
+}
+
+var connectExample = []byte{Version5, Connect, 0x00, 0x03, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x00, 0x50}
+
+func TestStaticAuthenticator(t *testing.T) {
+	auth := StaticAuthenticator{"alice": "secret", "bob": ""}
+	tests := []struct {
+		username, password string
+		want               bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "secre", false},
+		{"alice", "", false},
+		{"bob", "", true},
+		{"carol", "", false},
+	}
+	for _, tt := range tests {
+		if got := auth.Verify(tt.username, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestSocks5UserPassAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		status   byte
+	}{
+		{"valid", "secret", authSuccess},
+		{"invalid", "wrong", authFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.SetAuthenticator(StaticAuthenticator{"alice": "secret"})
+			conn := dialTestServer(t, s)
+
+			conn.Write([]byte{Version5, 2, MethodNoAuth, MethodUserPass})
+			expectBytes(t, conn, []byte{Version5, MethodUserPass})
+			req := []byte{userPassVersion, 5, 'a', 'l', 'i', 'c', 'e', byte(len(tt.password))}
+			conn.Write(append(req, tt.password...))
+			expectBytes(t, conn, []byte{userPassVersion, tt.status})
+			if tt.status != authSuccess {
+				return
+			}
+			conn.Write(connectExample)
+			if c := acceptTestConn(t, s); c.User() != "alice" || c.Metadata().String() != "example.com:80" {
+				t.Errorf("got user %q addr %v", c.User(), c.Metadata())
+			}
+		})
+	}
+}
+
+func TestSocks5NoAcceptableMethod(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAuthenticator(StaticAuthenticator{"alice": "secret"})
+	conn := dialTestServer(t, s)
+
+	conn.Write([]byte{Version5, 1, MethodNoAuth})
+	expectBytes(t, conn, []byte{Version5, MethodNoAcceptable})
+}
+
+func TestHttpProxyAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"missing", "", http.StatusProxyAuthRequired},
+		{"invalid", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong")), http.StatusProxyAuthRequired},
+		{"valid", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.SetAuthenticator(StaticAuthenticator{"alice": "secret"})
+			conn := dialTestServer(t, s)
+
+			req := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n"
+			if tt.header != "" {
+				req += "Proxy-Authorization: " + tt.header + "\r\n"
+			}
+			conn.Write([]byte(req + "\r\n"))
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				if c := acceptTestConn(t, s); c.User() != "alice" {
+					t.Errorf("got user %q", c.User())
+				}
+			}
+		})
+	}
+}
+
+func TestSocks4Connect(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		user    string
+		addr    string
+		reply   byte
+	}{
+		{
+			name:    "socks4",
+			request: []byte{Version4, Connect, 0x00, 0x50, 93, 184, 216, 34, 'b', 'o', 'b', 0x00},
+			user:    "bob",
+			addr:    "93.184.216.34:80",
+			reply:   socks4Granted,
+		},
+		{
+			name:    "socks4a",
+			request: append([]byte{Version4, Connect, 0x01, 0xBB, 0, 0, 0, 1, 0x00}, "example.com\x00"...),
+			addr:    "example.com:443",
+			reply:   socks4Granted,
+		},
+		{
+			name:    "bind",
+			request: []byte{Version4, 0x02, 0x00, 0x50, 93, 184, 216, 34, 0x00},
+			reply:   socks4Rejected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			conn := dialTestServer(t, s)
+
+			conn.Write(tt.request)
+			expectBytes(t, conn, []byte{0x00, tt.reply, 0, 0, 0, 0, 0, 0})
+			if tt.reply != socks4Granted {
+				return
+			}
+			c := acceptTestConn(t, s)
+			if c.User() != tt.user || c.Metadata().String() != tt.addr {
+				t.Errorf("got user %q addr %v, want %q %v", c.User(), c.Metadata(), tt.user, tt.addr)
+			}
+		})
+	}
+}
+
+func TestDeferredReply(t *testing.T) {
+	bound := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 0x1234}
+	tests := []struct {
+		name  string
+		rep   byte
+		bound net.Addr
+		want  []byte
+	}{
+		{"succeeded", ReplySucceeded, bound, []byte{Version5, ReplySucceeded, 0, 0x01, 10, 0, 0, 1, 0x12, 0x34}},
+		{"refused", ReplyConnectionRefused, nil, []byte{Version5, ReplyConnectionRefused, 0, 0x01, 0, 0, 0, 0, 0, 0}},
+		{"not allowed", ReplyNotAllowed, nil, []byte{Version5, ReplyNotAllowed, 0, 0x01, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.SetDeferredReply(true)
+			conn := dialTestServer(t, s)
+
+			conn.Write([]byte{Version5, 1, MethodNoAuth})
+			expectBytes(t, conn, []byte{Version5, MethodNoAuth})
+			conn.Write(connectExample)
+			c := acceptTestConn(t, s)
+			c.Reply(tt.rep, tt.bound)
+			c.Reply(ReplyGeneralFailure, nil) // ignored
+			expectBytes(t, conn, tt.want)
+		})
+	}
+}
+
+func TestDeferredReplyHttp(t *testing.T) {
+	tests := []struct {
+		name   string
+		rep    byte
+		status int
+	}{
+		{"succeeded", ReplySucceeded, http.StatusOK},
+		{"not allowed", ReplyNotAllowed, http.StatusForbidden},
+		{"ttl expired", ReplyTTLExpired, http.StatusGatewayTimeout},
+		{"refused", ReplyConnectionRefused, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.SetDeferredReply(true)
+			conn := dialTestServer(t, s)
+
+			conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nUser-Agent: curl/8.0\r\n\r\n"))
+			c := acceptTestConn(t, s)
+			if ua := c.Metadata().UserAgent(); ua != "curl/8.0" {
+				t.Errorf("got user agent %q", ua)
+			}
+			c.Reply(tt.rep, nil)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, refused := net.Dial("tcp", addr)
+
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"nil", nil, ReplySucceeded},
+		{"refused", refused, ReplyConnectionRefused},
+		{"dns", &net.DNSError{Err: "no such host", Name: "invalid."}, ReplyHostUnreachable},
+		{"timeout", &net.OpError{Op: "dial", Err: timeoutError{}}, ReplyTTLExpired},
+		{"other", io.ErrUnexpectedEOF, ReplyGeneralFailure},
+	}
+	for _, tt := range tests {
+		if got := ReplyCode(tt.err); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSocks5Bind(t *testing.T) {
+	s := newTestServer(t)
+	s.SetDeferredReply(true)
+	conn := dialTestServer(t, s)
+
+	conn.Write([]byte{Version5, 1, MethodNoAuth})
+	expectBytes(t, conn, []byte{Version5, MethodNoAuth})
+	conn.Write([]byte{Version5, Bind, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x00})
+	c := acceptTestConn(t, s)
+	if c.Metadata().Command != Bind {
+		t.Fatalf("got command %d, want BIND", c.Metadata().Command)
+	}
+	peerChan := make(chan net.Conn, 1)
+	go func() {
+		peer, err := c.ServeBind()
+		if err != nil {
+			t.Error(err)
+		}
+		peerChan <- peer
+	}()
+
+	first := make([]byte, 10)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		t.Fatal(err)
+	}
+	if first[1] != ReplySucceeded {
+		t.Fatalf("first reply %d", first[1])
+	}
+	port := int(first[8])<<8 | int(first[9])
+	incoming, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer incoming.Close()
+
+	second := make([]byte, 10)
+	if _, err := io.ReadFull(conn, second); err != nil {
+		t.Fatal(err)
+	}
+	if second[1] != ReplySucceeded || !bytes.Equal(second[4:8], []byte{127, 0, 0, 1}) {
+		t.Fatalf("second reply %x", second)
+	}
+	if peer := <-peerChan; peer == nil || peer.RemoteAddr().String() != incoming.LocalAddr().String() {
+		t.Fatalf("unexpected peer %v", peer)
+	}
+}
+
+func TestSocks5BindRequiresDeferredReply(t *testing.T) {
+	s := newTestServer(t)
+	conn := dialTestServer(t, s)
+
+	conn.Write([]byte{Version5, 1, MethodNoAuth})
+	expectBytes(t, conn, []byte{Version5, MethodNoAuth})
+	conn.Write([]byte{Version5, Bind, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x00})
+	expectBytes(t, conn, []byte{Version5, ReplyCommandNotSupported, 0, 0x01, 0, 0, 0, 0, 0, 0})
+}
+
+type testHttpDialer struct {
+	routes map[string]string
+	dials  []string
+}
+
+func (d *testHttpDialer) Dial(user string, metadata *tunnel.Metadata) (net.Conn, error) {
+	d.dials = append(d.dials, metadata.String())
+	target, ok := d.routes[metadata.String()]
+	if !ok {
+		return nil, ErrNotAllowed
+	}
+	return net.Dial("tcp", target)
+}
+
+func TestHttpProxyKeepAlive(t *testing.T) {
+	newOrigin := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Hop", "dropped")
+			w.Header().Set("Connection", "X-Hop")
+			fmt.Fprintf(w, "%s %s %s foo=%q expect=%q", name, r.Method, body, r.Header.Get("X-Foo"), r.Header.Get("Expect"))
+		}))
+	}
+	a, b := newOrigin("a"), newOrigin("b")
+	defer a.Close()
+	defer b.Close()
+
+	dialer := &testHttpDialer{routes: map[string]string{
+		"a.test:80": a.Listener.Addr().String(),
+		"b.test:80": b.Listener.Addr().String(),
+	}}
+	s := newTestServer(t)
+	s.AddHttpDialer(dialer)
+	conn := dialTestServer(t, s)
+	r := bufio.NewReader(conn)
+
+	roundTrip := func(req string) (*http.Response, string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	tests := []struct {
+		name   string
+		req    string
+		status int
+		body   string
+	}{
+		{
+			name:   "first host",
+			req:    "GET http://a.test/ HTTP/1.1\r\nHost: a.test\r\nConnection: X-Foo\r\nX-Foo: bar\r\n\r\n",
+			status: http.StatusOK,
+			body:   `a GET  foo="" expect=""`,
+		},
+		{
+			name:   "second host on same connection",
+			req:    "POST http://b.test/ HTTP/1.1\r\nHost: b.test\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+			status: http.StatusOK,
+			body:   `b POST hello world foo="" expect=""`,
+		},
+		{
+			name:   "rejected host",
+			req:    "GET http://c.test/ HTTP/1.1\r\nHost: c.test\r\n\r\n",
+			status: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		resp, body := roundTrip(tt.req)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		if tt.body != "" && body != tt.body {
+			t.Errorf("%s: got body %q, want %q", tt.name, body, tt.body)
+		}
+		if resp.Header.Get("X-Hop") != "" {
+			t.Errorf("%s: hop-by-hop header leaked", tt.name)
+		}
+	}
+	if want := []string{"a.test:80", "b.test:80", "c.test:80"}; strings.Join(dialer.dials, ",") != strings.Join(want, ",") {
+		t.Errorf("got dials %v, want %v", dialer.dials, want)
+	}
+}
+
+func TestHttpProxyUpstreamClosed(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Method)
+	}))
+	defer origin.Close()
+	dialer := &testHttpDialer{routes: map[string]string{"a.test:80": origin.Listener.Addr().String()}}
+	s := newTestServer(t)
+	s.AddHttpDialer(dialer)
+	conn := dialTestServer(t, s)
+	r := bufio.NewReader(conn)
+
+	for i, method := range []string{"GET", "HEAD", "GET"} {
+		if i > 0 {
+			// Drop the idle upstream connection behind the proxy's back.
+			origin.CloseClientConnections()
+		}
+		conn.Write([]byte(method + " http://a.test/ HTTP/1.1\r\nHost: a.test\r\n\r\n"))
+		resp, err := http.ReadResponse(r, &http.Request{Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s #%d: got status %d, want 200", method, i, resp.StatusCode)
+		}
+		if method == "GET" && string(body) != method {
+			t.Errorf("%s #%d: got body %q", method, i, body)
+		}
+	}
+	if len(dialer.dials) != 3 {
+		t.Errorf("got %d dials, want 3", len(dialer.dials))
+	}
+}
+
+func TestHttpProxyExpectContinue(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer origin.Close()
+	s := newTestServer(t)
+	s.AddHttpDialer(&testHttpDialer{routes: map[string]string{"a.test:80": origin.Listener.Addr().String()}})
+	conn := dialTestServer(t, s)
+	r := bufio.NewReader(conn)
+
+	conn.Write([]byte("PUT http://a.test/ HTTP/1.1\r\nHost: a.test\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n"))
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("got status %d, want 100", resp.StatusCode)
+	}
+	conn.Write([]byte("data"))
+	if resp, err = http.ReadResponse(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "data" {
+		t.Errorf("got body %q", body)
+	}
+}
+
+func TestHttpOnceAcceptLargeRequest(t *testing.T) {
+	s := newTestServer(t)
+	conn := dialTestServer(t, s)
+
+	body := strings.Repeat("x", 16*1024)
+	go conn.Write([]byte("POST http://example.com/upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 16384\r\n\r\n" + body))
+	c := acceptTestConn(t, s)
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(c.Payload())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(req.Body); string(got) != body {
+		t.Errorf("got body of %d bytes, want %d", len(got), len(body))
+	}
+}
+
+// associateTestClient opens a UDP association for client and returns its
+// control connection.
+func associateTestClient(t *testing.T, s *Server, client net.Addr) net.Conn {
+	t.Helper()
+	conn := dialTestServer(t, s)
+	conn.Write([]byte{Version5, 1, MethodNoAuth})
+	expectBytes(t, conn, []byte{Version5, MethodNoAuth})
+	req := append([]byte{Version5, Associate, 0x00}, ParseAddr(client.String())...)
+	conn.Write(req)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != ReplySucceeded {
+		t.Fatalf("associate reply %x", reply)
+	}
+	return conn
+}
+
+func TestAssociateBindsClient(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTimeout(time.Minute)
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+
+	// Nothing is relayed before the association exists.
+	addr := ParseAddr("1.2.3.4:53")
+	client.WriteTo(MakeUDPDatagram(addr, []byte("early")), s.udpListener.LocalAddr())
+	control := associateTestClient(t, s, client.LocalAddr())
+
+	// Only the declared client address may use the relay.
+	stranger.WriteTo(MakeUDPDatagram(addr, []byte("stranger")), s.udpListener.LocalAddr())
+	client.WriteTo(MakeUDPDatagram(addr, []byte("client")), s.udpListener.LocalAddr())
+	pc, err := s.AcceptPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, MaxPacketSize)
+	n, _, err := pc.ReadWithMetadata(buf)
+	if err != nil || string(buf[:n]) != "client" {
+		t.Fatalf("got %q %v, want client packet", buf[:n], err)
+	}
+	select {
+	case pc := <-s.packetChan:
+		t.Fatalf("unexpected session %v", pc)
+	default:
+	}
+
+	// Closing the control connection tears the session down.
+	control.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := pc.ReadWithMetadata(buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("session still readable after control connection closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("session not closed with control connection")
+	}
+}
+
+func TestAssociateIdleTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTimeout(100 * time.Millisecond)
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	associateTestClient(t, s, client.LocalAddr())
+
+	client.WriteTo(MakeUDPDatagram(ParseAddr("1.2.3.4:53"), []byte("ping")), s.udpListener.LocalAddr())
+	pc, err := s.AcceptPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, MaxPacketSize)
+	pc.ReadWithMetadata(buf)
+	if _, _, err = pc.ReadWithMetadata(buf); err == nil {
+		t.Error("session still readable after idle timeout")
+	}
+}
+
+func TestLookupAssociation(t *testing.T) {
+	s := newTestServer(t)
+	ip := net.ParseIP("192.0.2.1")
+	anyPort := &association{ip: ip}
+	exact := &association{ip: ip, port: 4000}
+	s.Lock()
+	s.associations[anyPort] = struct{}{}
+	s.associations[exact] = struct{}{}
+	s.Unlock()
+
+	if got := s.lookupAssociation(&net.UDPAddr{IP: ip, Port: 4000}); got != exact {
+		t.Errorf("port 4000 got %v, want the exact association", got)
+	}
+	if got := s.lookupAssociation(&net.UDPAddr{IP: ip, Port: 5000}); got != anyPort {
+		t.Errorf("port 5000 got %v, want the IP association", got)
+	}
+
+	// A second client behind the same address makes the IP match ambiguous.
+	s.Lock()
+	s.associations[&association{ip: ip}] = struct{}{}
+	s.Unlock()
+	if got := s.lookupAssociation(&net.UDPAddr{IP: ip, Port: 5000}); got != nil {
+		t.Errorf("ambiguous source got %v", got)
+	}
+	if got := s.lookupAssociation(&net.UDPAddr{IP: ip, Port: 4000}); got != exact {
+		t.Errorf("port 4000 got %v, want the exact association", got)
+	}
+}
+
+type testFakeIP map[string]string
+
+func (f testFakeIP) LookupIP(ip net.IP) (string, bool) {
+	host, ok := f[ip.String()]
+	return host, ok
+}
+
+func TestHttpFakeIP(t *testing.T) {
+	s := newTestServer(t)
+	s.SetFakeIP(testFakeIP{"198.18.0.1": "www.example.com"})
+	conn := dialTestServer(t, s)
+	conn.Write([]byte("CONNECT 198.18.0.1:443 HTTP/1.1\r\nHost: 198.18.0.1:443\r\n\r\n"))
+	c := acceptTestConn(t, s)
+	if m := c.Metadata(); m.AddrType() != tunnel.DomainName || m.String() != "www.example.com:443" {
+		t.Errorf("got %v", m)
+	}
+
+	// Without the option, fake addresses pass through.
+	s = newTestServer(t)
+	conn = dialTestServer(t, s)
+	conn.Write([]byte("CONNECT 198.18.0.1:443 HTTP/1.1\r\nHost: 198.18.0.1:443\r\n\r\n"))
+	if m := acceptTestConn(t, s).Metadata(); m.String() != "198.18.0.1:443" {
+		t.Errorf("got %v without a fake ip pool", m)
+	}
+}
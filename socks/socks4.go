@@ -0,0 +1,98 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"github.com/koomox/goproxy/tunnel"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Granted  byte = 0x5A
+	socks4Rejected byte = 0x5B
+
+	maxSocks4FieldLen = 255
+)
+
+var errSocks4FieldTooLong = errors.New("socks4 field too long")
+
+func (s *Server) handleSocks4(conn net.Conn) {
+	cmd, user, addr, err := s.handshake4(conn)
+	if err != nil {
+		conn.Close()
+		s.log.Errorf("socks4 failed to handshake with client %v", err.Error())
+		return
+	}
+	switch cmd {
+	case Connect:
+		metadata := &tunnel.Metadata{Command: Connect, Address: addr}
+		// Clients of a fake-IP DNS connect to addresses standing for domains.
+		s.reverseFakeIP(metadata)
+		c := &Conn{Conn: conn, metadata: metadata, user: user, payload: nil}
+		c.reply = func(rep byte, _ net.Addr) error { return reply4(conn, rep) }
+		if !s.deferReply {
+			if err = c.Reply(ReplySucceeded, nil); err != nil {
+				s.log.Errorf("socks4 failed to respond CONNECT %v", err.Error())
+				conn.Close()
+				return
+			}
+		}
+		s.log.Debug("socks4 connect", user, addr)
+		s.connChan <- c
+	default:
+		s.log.Errorf("unknown socks4 command %d", cmd)
+		reply4(conn, ReplyCommandNotSupported)
+		conn.Close()
+	}
+}
+
+// handshake4 reads a SOCKS4 or SOCKS4a request after the version byte:
+// CD | DSTPORT | DSTIP | USERID | NULL [| DOMAIN | NULL]
+func (s *Server) handshake4(rw io.ReadWriter) (cmd byte, user string, addr *tunnel.Address, err error) {
+	b := [7]byte{}
+	if _, err = io.ReadFull(rw, b[:]); err != nil {
+		return 0, "", nil, fmt.Errorf("failed to read socks4 request %v", err.Error())
+	}
+	cmd = b[0]
+	port := int(b[1])<<8 | int(b[2])
+	ip := net.IPv4(b[3], b[4], b[5], b[6])
+	if user, err = readNullString(rw); err != nil {
+		return 0, "", nil, fmt.Errorf("failed to read socks4 user id %v", err.Error())
+	}
+	// SOCKS5 authentication has no SOCKS4 equivalent.
+	if s.auth != nil {
+		reply4(rw, ReplyNotAllowed)
+		return 0, "", nil, errAuthFailed
+	}
+	host := ip.String()
+	// SOCKS4a: DSTIP 0.0.0.x with x != 0 means a domain name follows.
+	if b[3] == 0 && b[4] == 0 && b[5] == 0 && b[6] != 0 {
+		if host, err = readNullString(rw); err != nil {
+			return 0, "", nil, fmt.Errorf("failed to read socks4a domain %v", err.Error())
+		}
+	}
+	if addr, err = tunnel.ResolveAddr("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err != nil {
+		reply4(rw, ReplyGeneralFailure)
+		return 0, "", nil, err
+	}
+	return cmd, user, addr, nil
+}
+
+func readNullString(r io.Reader) (string, error) {
+	buf := make([]byte, 0, 32)
+	b := [1]byte{}
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0x00 {
+			return string(buf), nil
+		}
+		if len(buf) == maxSocks4FieldLen {
+			return "", errSocks4FieldTooLong
+		}
+		buf = append(buf, b[0])
+	}
+}
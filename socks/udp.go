@@ -0,0 +1,71 @@
+package socks
+
+import (
+	"errors"
+	"github.com/koomox/goproxy/tunnel"
+	"net"
+)
+
+const UdpBufSize = 64 * 1024
+
+var (
+	errShortDatagram   = errors.New("socks udp datagram is short")
+	errInvalidAddrType = errors.New("socks udp datagram has invalid ATYP")
+)
+
+// ParseAddr encodes a "host:port" string as a SOCKS address.
+// Returns nil on failure.
+func ParseAddr(s string) []byte {
+	addr, err := tunnel.ResolveAddr("udp", s)
+	if err != nil {
+		return nil
+	}
+	return addr.Bytes()
+}
+
+// SplitAddr slices the SOCKS address from the beginning of b.
+// Returns nil on failure.
+func SplitAddr(b []byte) []byte {
+	if len(b) < 1 {
+		return nil
+	}
+	addrLen := 1
+	switch b[0] {
+	case tunnel.DomainName:
+		if len(b) < 2 {
+			return nil
+		}
+		addrLen += 1 + int(b[1]) + 2
+	case tunnel.IPv4:
+		addrLen += net.IPv4len + 2
+	case tunnel.IPv6:
+		addrLen += net.IPv6len + 2
+	default:
+		return nil
+	}
+	if len(b) < addrLen {
+		return nil
+	}
+	return b[:addrLen]
+}
+
+// MakeUDPDatagram builds a SOCKS5 UDP request (RFC 1928 section 7)
+// with RSV and FRAG set to zero.
+func MakeUDPDatagram(addr, payload []byte) []byte {
+	b := make([]byte, 0, 3+len(addr)+len(payload))
+	b = append(b, 0, 0, 0)
+	b = append(b, addr...)
+	return append(b, payload...)
+}
+
+// SplitUDPDatagram splits a SOCKS5 UDP request into its FRAG field,
+// destination address and payload. addr and payload alias b.
+func SplitUDPDatagram(b []byte) (frag byte, addr, payload []byte, err error) {
+	if len(b) < 3+1+net.IPv4len+2 {
+		return 0, nil, nil, errShortDatagram
+	}
+	if addr = SplitAddr(b[3:]); addr == nil {
+		return 0, nil, nil, errInvalidAddrType
+	}
+	return b[2], addr, b[3+len(addr):], nil
+}
@@ -1,21 +1,50 @@
 package trojan
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"github.com/koomox/goproxy"
 	"github.com/koomox/goproxy/tunnel"
 	"net"
+	"sync"
 	"time"
 )
 
+const (
+	// poolIdleTimeout is how long a pooled connection is kept. It must stay
+	// below the first flight timeout of the server, which closes
+	// connections that have not sent the trojan header by then; see
+	// Server.SetFirstFlightTimeout.
+	poolIdleTimeout = firstFlightTimeout / 2
+	poolMaxBackoff  = 30 * time.Second
+)
+
 func Dial(network, address, ServerName string, timeout time.Duration, tlsCfg *tls.Config) (conn net.Conn, err error) {
-	rc, err := net.DialTimeout(network, address, timeout)
+	cfg := tlsCfg.Clone()
+	cfg.ServerName = ServerName
+	return dialTLS(context.Background(), network, address, timeout, cfg)
+}
+
+// dialTLS dials and handshakes within timeout, or without a limit when it
+// is zero, giving up when ctx is done.
+func dialTLS(ctx context.Context, network, address string, timeout time.Duration, cfg *tls.Config) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	rc, err := d.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
-	tlsCfg.ServerName = ServerName
-	conn = tls.Client(rc, tlsCfg)
-	err = conn.(*tls.Conn).Handshake()
-	return
+	conn := tls.Client(rc, cfg)
+	if err = conn.HandshakeContext(ctx); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return conn, nil
 }
 
 func DialConn(hash []byte, addr string, conn net.Conn) (tunnel.Conn, error) {
@@ -27,5 +56,275 @@ func DialConn(hash []byte, addr string, conn net.Conn) (tunnel.Conn, error) {
 }
 
 func DialPacket(hash []byte, conn net.Conn) (tunnel.PacketConn, error) {
-	return &PacketConn{&OutboundConn{Conn: conn, hash: hash, metadata: &tunnel.Metadata{Command: Associate, Address: &tunnel.Address{}}}}, nil
+	return &PacketConn{&OutboundConn{Conn: conn, hash: hash, metadata: &tunnel.Metadata{Command: Associate, Address: zeroAddr("udp")}}}, nil
+}
+
+type idleConn struct {
+	net.Conn
+	created time.Time
+}
+
+func (c *idleConn) fresh() bool {
+	return time.Since(c.created) < poolIdleTimeout
+}
+
+// Client dials a trojan server. It owns a copy of the TLS config with a
+// session cache so that new handshakes can resume, and keeps a pool of
+// idle TLS connections handshaked ahead of time. Pooled connections are
+// replaced before the server would time out their first flight.
+type Client struct {
+	network   string
+	address   string
+	hash      []byte
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	websocket *WebSocket
+	fakeIP    tunnel.FakeIP
+	pool      chan *idleConn
+	fillDone  chan struct{}
+
+	muxMu        sync.Mutex
+	muxStreams   int
+	muxKeepAlive time.Duration
+	sessions     []*muxSession
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	log    goproxy.Logger
+}
+
+// NewClient creates a client for the trojan server at addr. poolSize idle
+// connections are kept ready; zero disables the pool.
+func NewClient(addr, serverName string, hash []byte, poolSize int, timeout time.Duration, tlsConfig *tls.Config, ctx context.Context, log goproxy.Logger) *Client {
+	ctx, cancel := context.WithCancel(ctx)
+	var cfg *tls.Config
+	if tlsConfig != nil {
+		cfg = tlsConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	cfg.ServerName = serverName
+	if cfg.ClientSessionCache == nil {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(poolSize + 32)
+	}
+	c := &Client{
+		network:   "tcp",
+		address:   addr,
+		hash:      hash,
+		timeout:   timeout,
+		tlsConfig: cfg,
+		pool:      make(chan *idleConn, poolSize),
+		ctx:       ctx,
+		cancel:    cancel,
+		log:       log,
+	}
+	if poolSize > 0 {
+		c.fillDone = make(chan struct{})
+		go c.fillLoop()
+	}
+	return c
+}
+
+func (c *Client) Close() error {
+	c.cancel()
+	c.muxMu.Lock()
+	for _, sess := range c.sessions {
+		sess.Close()
+	}
+	c.sessions = nil
+	c.muxMu.Unlock()
+	// Once fillLoop is gone, nothing can be pushed after the drain.
+	if c.fillDone != nil {
+		<-c.fillDone
+	}
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// SetFakeIP makes the client send the domains that destinations handed
+// out by a fake-IP DNS, such as dns.FakeIPPool, stand for.
+func (c *Client) SetFakeIP(f tunnel.FakeIP) {
+	c.fakeIP = f
+}
+
+// DialConn returns a connection to addr through the trojan server.
+func (c *Client) DialConn(addr string) (tunnel.Conn, error) {
+	conn, err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	out, err := DialConn(c.hash, addr, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	out.Metadata().ReverseFakeIP(c.fakeIP)
+	return out, nil
+}
+
+// DialPacket returns a UDP association through the trojan server.
+func (c *Client) DialPacket() (tunnel.PacketConn, error) {
+	conn, err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	return DialPacket(c.hash, conn)
+}
+
+// SetMux makes the client carry up to maxStreams requests over each
+// connection, pinging the server every keepAlive. The server must be a
+// Server of this package with mux enabled too: the framing borrows from
+// smux but is not wire compatible with it, and each stream carries a full
+// trojan request, so trojan-go and other smux based servers cannot serve
+// it.
+func (c *Client) SetMux(maxStreams int, keepAlive time.Duration) {
+	if maxStreams <= 0 {
+		maxStreams = DefaultMuxStreams
+	}
+	c.muxMu.Lock()
+	c.muxStreams, c.muxKeepAlive = maxStreams, keepAlive
+	c.muxMu.Unlock()
+}
+
+// open returns what a request is written to: a stream of a mux session
+// with room left, or a connection of its own. The lock only guards the
+// sessions; dialing happens outside it.
+func (c *Client) open() (net.Conn, error) {
+	c.muxMu.Lock()
+	maxStreams, keepAlive := c.muxStreams, c.muxKeepAlive
+	if maxStreams == 0 {
+		c.muxMu.Unlock()
+		return c.transport()
+	}
+	live := c.sessions[:0]
+	for _, sess := range c.sessions {
+		if !sess.IsClosed() {
+			live = append(live, sess)
+		}
+	}
+	c.sessions = live
+	for _, sess := range c.sessions {
+		if st, err := sess.OpenStream(); err == nil {
+			c.muxMu.Unlock()
+			return st, nil
+		}
+	}
+	c.muxMu.Unlock()
+
+	conn, err := c.transport()
+	if err != nil {
+		return nil, err
+	}
+	header := &tunnel.Metadata{Command: Mux, Address: zeroAddr("tcp")}
+	sess := newMuxSession(&OutboundConn{Conn: conn, hash: c.hash, metadata: header}, true, maxStreams, keepAlive)
+	c.muxMu.Lock()
+	if c.ctx.Err() != nil {
+		c.muxMu.Unlock()
+		sess.Close()
+		return nil, errors.New("trojan client closed")
+	}
+	c.sessions = append(c.sessions, sess)
+	c.muxMu.Unlock()
+	return sess.OpenStream()
+}
+
+// transport returns a connection to the server, over WebSocket if set.
+func (c *Client) transport() (net.Conn, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	if c.websocket != nil {
+		conn = WebSocketClient(conn, c.websocket)
+	}
+	return conn, nil
+}
+
+// dial takes an idle connection from the pool, or handshakes a new one
+// when the pool is empty.
+func (c *Client) dial() (net.Conn, error) {
+	for {
+		select {
+		case conn := <-c.pool:
+			if conn.fresh() {
+				return conn.Conn, nil
+			}
+			conn.Close()
+			continue
+		case <-c.ctx.Done():
+			return nil, errors.New("trojan client closed")
+		default:
+		}
+		return dialTLS(c.ctx, c.network, c.address, c.timeout, c.tlsConfig)
+	}
+}
+
+func (c *Client) fillLoop() {
+	defer close(c.fillDone)
+	ticker := time.NewTicker(poolIdleTimeout / 2)
+	defer ticker.Stop()
+	backoff := time.Second
+	for {
+		conn, err := dialTLS(c.ctx, c.network, c.address, c.timeout, c.tlsConfig)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			c.log.Errorf("trojan failed to prewarm connection %v", err.Error())
+			select {
+			case <-time.After(backoff):
+			case <-c.ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > poolMaxBackoff {
+				backoff = poolMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		idle := &idleConn{Conn: conn, created: time.Now()}
+	push:
+		for {
+			select {
+			case c.pool <- idle:
+				break push
+			case <-ticker.C:
+				c.evict()
+				if !idle.fresh() {
+					idle.Close()
+					break push
+				}
+			case <-c.ctx.Done():
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// evict closes the pooled connections that are no longer fresh, making
+// room for fillLoop to replace them.
+func (c *Client) evict() {
+	for i := len(c.pool); i > 0; i-- {
+		select {
+		case conn := <-c.pool:
+			if !conn.fresh() {
+				conn.Close()
+				continue
+			}
+			select {
+			case c.pool <- conn:
+			default:
+				conn.Close()
+			}
+		default:
+			return
+		}
+	}
 }
@@ -0,0 +1,269 @@
+package trojan
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/koomox/goproxy/tunnel"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Info(...interface{})           {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Error(...interface{})          {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+func (nopLogger) Debug(...interface{})          {}
+
+type testHook struct {
+	hash string
+}
+
+func (h *testHook) Auth(hash string) bool                              { return hash == h.hash }
+func (h *testHook) Router(string, *tunnel.Metadata) byte               { return ActionProxy }
+func (h *testHook) Forward(string, *tunnel.Metadata) (net.Conn, error) { return nil, io.EOF }
+
+var testPassword = []byte("password")
+
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "trojan.test"},
+		DNSNames:     []string{"trojan.test", "www.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTestServer starts a trojan server and returns it with a client TLS
+// config that trusts its certificate.
+func newTestServer(t *testing.T, front string) (*Server, *tls.Config) {
+	t.Helper()
+	cert := testCertificate(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+	s, err := NewServer(front, "127.0.0.1:0", tlsConfig, context.Background(), nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddHook(&testHook{hash: string(Sha224(testPassword))})
+	t.Cleanup(func() { s.Close() })
+	roots := x509.NewCertPool()
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots.AddCert(leaf)
+	return s, &tls.Config{RootCAs: roots}
+}
+
+func acceptTestConn(t *testing.T, s *Server) tunnel.Conn {
+	t.Helper()
+	ch := make(chan tunnel.Conn, 1)
+	go func() {
+		if conn, err := s.AcceptConn(); err == nil {
+			ch <- conn
+		}
+	}()
+	select {
+	case conn := <-ch:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for connection")
+		return nil
+	}
+}
+
+func TestClientDialConn(t *testing.T) {
+	s, cfg := newTestServer(t, "127.0.0.1:1")
+	c := NewClient(s.tcpListener.Addr().String(), "trojan.test", Sha224(testPassword), 0, time.Second, cfg, context.Background(), nopLogger{})
+	defer c.Close()
+
+	conn, err := c.DialConn("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	in := acceptTestConn(t, s)
+	if in.Metadata().String() != "example.com:80" {
+		t.Errorf("got metadata %v", in.Metadata())
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(in, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("got %q %v", buf, err)
+	}
+	if cfg.ServerName != "" {
+		t.Errorf("caller tls config mutated: ServerName %q", cfg.ServerName)
+	}
+}
+
+func TestClientZeroTimeout(t *testing.T) {
+	s, cfg := newTestServer(t, "127.0.0.1:1")
+	// Zero means no timeout, as for net.DialTimeout.
+	c := NewClient(s.tcpListener.Addr().String(), "trojan.test", Sha224(testPassword), 2, 0, cfg, context.Background(), nopLogger{})
+	conn, err := c.DialConn("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.pool) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Close()
+	if n := len(c.pool); n != 0 {
+		t.Errorf("%d idle connections left after Close", n)
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	var accepted int32
+	cert := testCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			defer conn.Close()
+			go conn.(*tls.Conn).Handshake()
+		}
+	}()
+
+	c := NewClient(l.Addr().String(), "trojan.test", Sha224(testPassword), 3, time.Second, &tls.Config{InsecureSkipVerify: true}, context.Background(), nopLogger{})
+	defer c.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.pool) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(c.pool) != 3 {
+		t.Fatalf("pool has %d idle connections, want 3", len(c.pool))
+	}
+	if n := atomic.LoadInt32(&accepted); n < 3 {
+		t.Errorf("server accepted %d connections, want at least 3", n)
+	}
+	if _, err = c.DialConn("example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientSessionResumption(t *testing.T) {
+	s, cfg := newTestServer(t, "127.0.0.1:1")
+	c := NewClient(s.tcpListener.Addr().String(), "trojan.test", Sha224(testPassword), 0, time.Second, cfg, context.Background(), nopLogger{})
+	defer c.Close()
+
+	// The session ticket is only processed once the client reads.
+	first, err := c.DialConn("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write([]byte("ping"))
+	in := acceptTestConn(t, s)
+	in.Write([]byte("pong"))
+	io.ReadFull(first, make([]byte, 4))
+
+	conn, err := c.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !conn.(*tls.Conn).ConnectionState().DidResume {
+		t.Error("second handshake did not resume the TLS session")
+	}
+}
+
+func TestClientPoolIdle(t *testing.T) {
+	s, cfg := newTestServer(t, "127.0.0.1:1")
+	c := NewClient(s.tcpListener.Addr().String(), "trojan.test", Sha224(testPassword), 2, time.Second, cfg, context.Background(), nopLogger{})
+	defer c.Close()
+
+	// Idle past the first flight timeout of the server.
+	time.Sleep(firstFlightTimeout + time.Second)
+	conn, err := c.DialConn("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	in := acceptTestConn(t, s)
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(in, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("got %q %v", buf, err)
+	}
+}
+
+func TestServerFirstFlightTimeout(t *testing.T) {
+	s, cfg := newTestServer(t, "127.0.0.1:1")
+	s.SetFirstFlightTimeout(firstFlightTimeout + 2*time.Second)
+	cfg.ServerName = "trojan.test"
+	rc, err := Dial("tcp", s.tcpListener.Addr().String(), "trojan.test", time.Second, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Handshaked early, the request comes after the default timeout.
+	time.Sleep(firstFlightTimeout + 500*time.Millisecond)
+	conn, _ := DialConn(Sha224(testPassword), "example.com:80", rc)
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	in := acceptTestConn(t, s)
+	if in.Metadata().String() != "example.com:80" {
+		t.Errorf("got metadata %v", in.Metadata())
+	}
+}
+
+type testFakeIP map[string]string
+
+func (f testFakeIP) LookupIP(ip net.IP) (string, bool) {
+	host, ok := f[ip.String()]
+	return host, ok
+}
+
+func TestClientFakeIP(t *testing.T) {
+	s, cfg := newTestServer(t, "127.0.0.1:1")
+	c := NewClient(s.tcpListener.Addr().String(), "trojan.test", Sha224(testPassword), 0, time.Second, cfg, context.Background(), nopLogger{})
+	c.SetFakeIP(testFakeIP{"198.18.0.1": "www.example.com"})
+	defer c.Close()
+
+	conn, err := c.DialConn("198.18.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	if in := acceptTestConn(t, s); in.Metadata().String() != "www.example.com:80" {
+		t.Errorf("server got %v", in.Metadata())
+	}
+}
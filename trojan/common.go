@@ -3,6 +3,8 @@ package trojan
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"github.com/koomox/goproxy/tunnel"
+	"net"
 )
 
 var (
@@ -32,3 +34,9 @@ func Sha224(b []byte) []byte {
 	hex.Encode(dst, src)
 	return dst
 }
+
+// zeroAddr is the address sent in request headers that have no target,
+// 0.0.0.0:0.
+func zeroAddr(network string) *tunnel.Address {
+	return &tunnel.Address{NetworkType: network, AddressType: tunnel.IPv4, IP: net.IPv4zero.To4()}
+}
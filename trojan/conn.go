@@ -66,12 +66,21 @@ type InboundConn struct {
 	net.Conn
 	hash     string
 	metadata *tunnel.Metadata
+	user     *User
 }
 
 func (c *InboundConn) Close() error {
+	if c.user != nil {
+		c.user.delConn(c)
+	}
 	return c.Conn.Close()
 }
 
+// User returns the store user the connection is accounted to, if any.
+func (c *InboundConn) User() *User {
+	return c.user
+}
+
 func (c *InboundConn) Metadata() *tunnel.Metadata {
 	return c.metadata
 }
@@ -81,9 +90,17 @@ func (c *InboundConn) Hash() string {
 }
 
 func (c *InboundConn) Write(b []byte) (int, error) {
-	return c.Conn.Write(b)
+	n, err := c.Conn.Write(b)
+	if c.user != nil && n > 0 {
+		c.user.addDownload(n)
+	}
+	return n, err
 }
 
 func (c *InboundConn) Read(b []byte) (int, error) {
-	return c.Conn.Read(b)
+	n, err := c.Conn.Read(b)
+	if c.user != nil && n > 0 {
+		c.user.addUpload(n)
+	}
+	return n, err
 }
@@ -0,0 +1,215 @@
+package trojan
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	hashLen = 56
+
+	// firstFlightTimeout bounds how long a client may take to send the
+	// trojan header before the connection is handed to a fallback.
+	firstFlightTimeout = 2 * time.Second
+	handshakeTimeout   = 10 * time.Second
+	maxRequestLineLen  = 4096
+	maxMethodLen       = 16
+)
+
+var (
+	errInvalidHash = errors.New("trojan hash is not hex")
+	errHashCRLF    = errors.New("trojan hash is not followed by CRLF")
+)
+
+// Fallback is where connections that are not trojan clients are sent. An
+// empty ServerName, ALPN or Path matches anything; Path is a prefix of the
+// request path of an HTTP/1.x first request.
+type Fallback struct {
+	ServerName string
+	ALPN       string
+	Path       string
+	Addr       string
+}
+
+// AddFallback adds a fallback. The fallback with the most matching fields
+// wins, earlier ones on a tie, and the front address of NewServer is used
+// when none matches.
+func (s *Server) AddFallback(fallback *Fallback) {
+	s.Lock()
+	s.fallbacks = append(s.fallbacks, fallback)
+	s.Unlock()
+}
+
+// bufferedConn reads through the reader that parsed the trojan header.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// readHash peeks the hash and its CRLF, which may arrive split across
+// several TLS records. Nothing is consumed from r, so the whole first
+// flight is still there for a fallback. A byte that cannot belong to a
+// hash fails at once.
+func (s *Server) readHash(r *bufio.Reader) (string, error) {
+	for {
+		n := r.Buffered() + 1
+		if n > hashLen+len(CRLF) {
+			n = hashLen + len(CRLF)
+		}
+		b, err := r.Peek(n)
+		hash := b
+		if len(hash) > hashLen {
+			hash = hash[:hashLen]
+		}
+		for _, ch := range hash {
+			if !('0' <= ch && ch <= '9' || 'a' <= ch && ch <= 'f') {
+				return "", errInvalidHash
+			}
+		}
+		if len(b) == hashLen+len(CRLF) {
+			if !bytes.Equal(b[hashLen:], CRLF) {
+				return "", errHashCRLF
+			}
+			return string(hash), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// selectFallback picks the fallback address for a connection.
+func (s *Server) selectFallback(c net.Conn, r *bufio.Reader) string {
+	s.RLock()
+	fallbacks := s.fallbacks
+	s.RUnlock()
+	if len(fallbacks) == 0 {
+		return s.front
+	}
+	var state tls.ConnectionState
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		state = tlsConn.ConnectionState()
+	}
+	path := ""
+	for _, fb := range fallbacks {
+		if fb.Path != "" {
+			// A slow client gets to finish its request line; what is
+			// not one is given up on without waiting for more.
+			c.SetReadDeadline(time.Time{})
+			path = requestPath(r)
+			break
+		}
+	}
+
+	addr, best := s.front, -1
+	for _, fb := range fallbacks {
+		score := 0
+		for _, field := range [][2]string{{fb.ServerName, state.ServerName}, {fb.ALPN, state.NegotiatedProtocol}} {
+			if field[0] == "" {
+				continue
+			}
+			if !strings.EqualFold(field[0], field[1]) {
+				score = -1
+				break
+			}
+			score++
+		}
+		if score < 0 {
+			continue
+		}
+		if fb.Path != "" {
+			if !strings.HasPrefix(path, fb.Path) {
+				continue
+			}
+			score++
+		}
+		if score > best {
+			addr, best = fb.Addr, score
+		}
+	}
+	return addr
+}
+
+// requestPath returns the path of the HTTP/1.x request line at the start
+// of the first flight, reading a little more if the line is incomplete.
+func requestPath(r *bufio.Reader) string {
+	var line []byte
+	for {
+		b, err := r.Peek(r.Buffered())
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i]
+			break
+		}
+		if err != nil || len(b) >= maxRequestLineLen || !requestLinePrefix(b) {
+			return ""
+		}
+		if _, err = r.Peek(len(b) + 1); err != nil {
+			return ""
+		}
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/1.") {
+		return ""
+	}
+	return fields[1]
+}
+
+// requestLinePrefix reports whether b may start an HTTP request line,
+// that is an upper case method followed by a space.
+func requestLinePrefix(b []byte) bool {
+	for i, ch := range b {
+		if ch == ' ' {
+			return i > 0
+		}
+		if ch < 'A' || ch > 'Z' || i >= maxMethodLen {
+			return false
+		}
+	}
+	return true
+}
+
+// frontPage relays the connection, including everything read from it so
+// far, to a fallback.
+func (s *Server) frontPage(c net.Conn, r *bufio.Reader) {
+	defer c.Close()
+	addr := s.selectFallback(c, r)
+	c.SetReadDeadline(time.Time{})
+	rc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	// r may hold a read deadline error, so only its buffer is used.
+	if b, _ := r.Peek(r.Buffered()); len(b) > 0 {
+		if _, err = rc.Write(b); err != nil {
+			return
+		}
+	}
+
+	errChan := make(chan error, 2)
+	copyConn := func(left, right net.Conn) {
+		_, errInfo := io.Copy(left, right)
+		errChan <- errInfo
+	}
+	go copyConn(c, rc)
+	go copyConn(rc, c)
+	select {
+	case ch := <-errChan:
+		if ch != nil {
+			s.log.Errorf("trojan relay error %v", ch.Error())
+		}
+	case <-s.ctx.Done():
+		s.log.Debug("trojan server closed")
+		return
+	}
+}
@@ -0,0 +1,156 @@
+package trojan
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fallbackListener records the first bytes each fallback connection sends.
+func fallbackListener(t *testing.T) (string, chan []byte) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ch := make(chan []byte, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+				b, _ := io.ReadAll(conn)
+				ch <- b
+			}()
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+func expectFallback(t *testing.T, ch chan []byte, want []byte) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if !bytes.Equal(got, want) {
+			t.Errorf("fallback got %q, want %q", got, want)
+		}
+	case <-time.After(firstFlightTimeout + 2*time.Second):
+		t.Error("fallback got nothing")
+	}
+}
+
+func TestFragmentedHash(t *testing.T) {
+	s, cfg := newTestServer(t, "127.0.0.1:1")
+	cfg.ServerName = "trojan.test"
+	conn, err := tls.Dial("tcp", s.tcpListener.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	header := append(Sha224(testPassword), CRLF...)
+	header = append(header, Connect, 0x03, 11)
+	header = append(header, "example.com\x00\x50\r\nping"...)
+	// Every write is its own TLS record.
+	for _, part := range [][]byte{header[:10], header[10:40], header[40:57], header[57:]} {
+		conn.Write(part)
+		time.Sleep(10 * time.Millisecond)
+	}
+	in := acceptTestConn(t, s)
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(in, buf); err != nil || string(buf) != "ping" || in.Metadata().String() != "example.com:80" {
+		t.Errorf("got %q %v %v", buf, in.Metadata(), err)
+	}
+}
+
+func TestFallbackSelection(t *testing.T) {
+	front, frontCh := fallbackListener(t)
+	sni, sniCh := fallbackListener(t)
+	h2, h2Ch := fallbackListener(t)
+	api, apiCh := fallbackListener(t)
+
+	s, cfg := newTestServer(t, front)
+	s.AddFallback(&Fallback{ServerName: "www.test", Addr: sni})
+	s.AddFallback(&Fallback{ALPN: "h2", Addr: h2})
+	s.AddFallback(&Fallback{ALPN: "http/1.1", Path: "/api", Addr: api})
+
+	tests := []struct {
+		name       string
+		serverName string
+		alpn       string
+		flight     []byte
+		ch         chan []byte
+	}{
+		{"sni", "www.test", "http/1.1", []byte("GET / HTTP/1.1\r\nHost: www.test\r\n\r\n"), sniCh},
+		{"alpn", "trojan.test", "h2", []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), h2Ch},
+		{"path", "trojan.test", "http/1.1", []byte("GET /api/v1 HTTP/1.1\r\nHost: trojan.test\r\n\r\n"), apiCh},
+		{"front", "trojan.test", "http/1.1", []byte("GET / HTTP/1.1\r\nHost: trojan.test\r\n\r\n"), frontCh},
+		{"short hex probe", "trojan.test", "", []byte("0123abcd"), frontCh},
+		{"wrong hash", "trojan.test", "", append(Sha224([]byte("wrong")), "\r\n\x01\x01\x01\x02\x03\x04\x00\x50\r\n"...), frontCh},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cfg.Clone()
+			c.ServerName = tt.serverName
+			if tt.alpn != "" {
+				c.NextProtos = []string{tt.alpn}
+			}
+			conn, err := tls.Dial("tcp", s.tcpListener.Addr().String(), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write(tt.flight)
+			expectFallback(t, tt.ch, tt.flight)
+		})
+	}
+}
+
+func TestFallbackSlowRequestLine(t *testing.T) {
+	front, frontCh := fallbackListener(t)
+	api, apiCh := fallbackListener(t)
+	s, cfg := newTestServer(t, front)
+	s.AddFallback(&Fallback{Path: "/api", Addr: api})
+
+	c := cfg.Clone()
+	c.ServerName = "trojan.test"
+	conn, err := tls.Dial("tcp", s.tcpListener.Addr().String(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The request line outlasts the first flight deadline.
+	conn.Write([]byte("GET /ap"))
+	time.Sleep(firstFlightTimeout + 500*time.Millisecond)
+	conn.Write([]byte("i/v1 HTTP/1.1\r\n\r\n"))
+	expectFallback(t, apiCh, []byte("GET /api/v1 HTTP/1.1\r\n\r\n"))
+	select {
+	case b := <-frontCh:
+		t.Errorf("front got %q", b)
+	default:
+	}
+}
+
+func TestClientDialPacketFallbackIgnored(t *testing.T) {
+	s, cfg := newTestServer(t, "127.0.0.1:1")
+	c := NewClient(s.tcpListener.Addr().String(), "trojan.test", Sha224(testPassword), 0, time.Second, cfg, context.Background(), nopLogger{})
+	defer c.Close()
+	pc, err := c.DialPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	dst, _ := net.ResolveUDPAddr("udp", "1.2.3.4:53")
+	if _, err = pc.WriteTo([]byte("query"), dst); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,475 @@
+package trojan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Mux is the trojan command that turns a connection into a session of
+// multiplexed streams. Each stream then carries a complete trojan request,
+// hash included, as if it were a connection of its own. The command is the
+// one trojan-go uses, but the session is not smux: both ends must be this
+// package.
+const Mux byte = 0x7F
+
+const (
+	muxVersion byte = 1
+
+	muxSYN byte = 0x00
+	muxFIN byte = 0x01
+	muxPSH byte = 0x02
+	muxNOP byte = 0x03
+	muxUPD byte = 0x04
+
+	muxHeaderLen    = 8
+	muxMaxFrameSize = 16 * 1024
+	muxStreamWindow = 256 * 1024
+
+	DefaultMuxStreams   = 8
+	DefaultMuxKeepAlive = 10 * time.Second
+)
+
+var (
+	errMuxClosed     = errors.New("trojan mux session closed")
+	errStreamClosed  = errors.New("trojan mux stream closed")
+	errMuxTooMany    = errors.New("trojan mux session is full")
+	errMuxWindow     = errors.New("trojan mux peer overran the stream window")
+	errMuxKeepAlive  = errors.New("trojan mux keepalive timeout")
+	errMuxBadVersion = errors.New("trojan mux frame version is unknown")
+)
+
+// muxSession carries streams over one connection. A frame is version,
+// command, a little endian uint16 length and uint32 stream id, then the
+// payload. Clients open odd stream ids.
+type muxSession struct {
+	lastRecv   int64
+	conn       net.Conn
+	client     bool
+	maxStreams int
+	keepAlive  time.Duration
+
+	mu      sync.Mutex
+	nextID  uint32
+	streams map[uint32]*muxStream
+	accept  chan *muxStream
+
+	wmu      sync.Mutex
+	die      chan struct{}
+	dieOnce  sync.Once
+	dieError error
+}
+
+func newMuxSession(conn net.Conn, client bool, maxStreams int, keepAlive time.Duration) *muxSession {
+	if maxStreams <= 0 {
+		maxStreams = DefaultMuxStreams
+	}
+	if keepAlive <= 0 {
+		keepAlive = DefaultMuxKeepAlive
+	}
+	m := &muxSession{
+		lastRecv:   time.Now().UnixNano(),
+		conn:       conn,
+		client:     client,
+		maxStreams: maxStreams,
+		keepAlive:  keepAlive,
+		nextID:     1,
+		streams:    make(map[uint32]*muxStream),
+		accept:     make(chan *muxStream, maxStreams),
+		die:        make(chan struct{}),
+	}
+	if !client {
+		m.nextID = 2
+	}
+	go m.recvLoop()
+	go m.keepAliveLoop()
+	return m
+}
+
+func (m *muxSession) Close() error {
+	m.closeWith(errMuxClosed)
+	return nil
+}
+
+func (m *muxSession) closeWith(err error) {
+	m.dieOnce.Do(func() {
+		m.dieError = err
+		close(m.die)
+		m.conn.Close()
+		m.mu.Lock()
+		for _, st := range m.streams {
+			st.notify()
+		}
+		m.mu.Unlock()
+	})
+}
+
+func (m *muxSession) IsClosed() bool {
+	select {
+	case <-m.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *muxSession) NumStreams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams)
+}
+
+// OpenStream opens a new stream, failing once maxStreams are open.
+func (m *muxSession) OpenStream() (*muxStream, error) {
+	if m.IsClosed() {
+		return nil, errMuxClosed
+	}
+	m.mu.Lock()
+	if len(m.streams) >= m.maxStreams {
+		m.mu.Unlock()
+		return nil, errMuxTooMany
+	}
+	st := newMuxStream(m.nextID, m)
+	m.nextID += 2
+	m.streams[st.id] = st
+	m.mu.Unlock()
+	if err := m.writeFrame(muxSYN, st.id, nil); err != nil {
+		m.removeStream(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for a stream opened by the peer.
+func (m *muxSession) AcceptStream() (*muxStream, error) {
+	select {
+	case st := <-m.accept:
+		return st, nil
+	case <-m.die:
+		return nil, m.dieError
+	}
+}
+
+func (m *muxSession) removeStream(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+func (m *muxSession) writeFrame(cmd byte, id uint32, payload []byte) error {
+	b := make([]byte, muxHeaderLen+len(payload))
+	b[0], b[1] = muxVersion, cmd
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(payload)))
+	binary.LittleEndian.PutUint32(b[4:], id)
+	copy(b[muxHeaderLen:], payload)
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	if m.IsClosed() {
+		return m.dieError
+	}
+	if _, err := m.conn.Write(b); err != nil {
+		m.closeWith(err)
+		return err
+	}
+	return nil
+}
+
+func (m *muxSession) recvLoop() {
+	h := [muxHeaderLen]byte{}
+	buf := make([]byte, 1<<16)
+	for {
+		if _, err := io.ReadFull(m.conn, h[:]); err != nil {
+			m.closeWith(err)
+			return
+		}
+		if h[0] != muxVersion {
+			m.closeWith(errMuxBadVersion)
+			return
+		}
+		atomic.StoreInt64(&m.lastRecv, time.Now().UnixNano())
+		cmd, id := h[1], binary.LittleEndian.Uint32(h[4:])
+		payload := buf[:binary.LittleEndian.Uint16(h[2:])]
+		if _, err := io.ReadFull(m.conn, payload); err != nil {
+			m.closeWith(err)
+			return
+		}
+
+		m.mu.Lock()
+		st := m.streams[id]
+		m.mu.Unlock()
+		switch cmd {
+		case muxNOP:
+		case muxSYN:
+			if st != nil || (id%2 == 1) == m.client {
+				continue
+			}
+			m.mu.Lock()
+			full := len(m.streams) >= m.maxStreams
+			if !full {
+				st = newMuxStream(id, m)
+				m.streams[id] = st
+			}
+			m.mu.Unlock()
+			if full {
+				m.writeFrame(muxFIN, id, nil)
+				continue
+			}
+			select {
+			case m.accept <- st:
+			case <-m.die:
+				return
+			}
+		case muxPSH:
+			if st == nil {
+				continue
+			}
+			if err := st.push(payload); err != nil {
+				m.closeWith(err)
+				return
+			}
+		case muxFIN:
+			if st != nil {
+				st.fin()
+			}
+		case muxUPD:
+			if st != nil && len(payload) == 4 {
+				st.update(binary.LittleEndian.Uint32(payload))
+			}
+		default:
+			m.closeWith(fmt.Errorf("trojan mux unknown command %v", cmd))
+			return
+		}
+	}
+}
+
+// keepAliveLoop pings the peer and closes the session when nothing has
+// been heard from it for three intervals.
+func (m *muxSession) keepAliveLoop() {
+	ticker := time.NewTicker(m.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&m.lastRecv))) > 3*m.keepAlive {
+				m.closeWith(errMuxKeepAlive)
+				return
+			}
+			m.writeFrame(muxNOP, 0, nil)
+		case <-m.die:
+			return
+		}
+	}
+}
+
+// muxStream is a stream of a session. The peer may send at most
+// muxStreamWindow bytes that have not been read yet; consumed bytes are
+// acknowledged with UPD frames.
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	mu         sync.Mutex
+	buf        []byte
+	consumed   uint32
+	acked      uint32
+	sent       uint32
+	peerRead   uint32
+	finRecv    bool
+	closed     bool
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+
+	readDeadline  atomic.Value
+	writeDeadline atomic.Value
+}
+
+func newMuxStream(id uint32, sess *muxSession) *muxStream {
+	st := &muxStream{
+		id:         id,
+		sess:       sess,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+	}
+	st.readDeadline.Store(time.Time{})
+	st.writeDeadline.Store(time.Time{})
+	return st
+}
+
+func (st *muxStream) notify() {
+	select {
+	case st.readEvent <- struct{}{}:
+	default:
+	}
+	select {
+	case st.writeEvent <- struct{}{}:
+	default:
+	}
+}
+
+func (st *muxStream) push(b []byte) error {
+	st.mu.Lock()
+	if len(st.buf)+len(b) > muxStreamWindow {
+		st.mu.Unlock()
+		return errMuxWindow
+	}
+	st.buf = append(st.buf, b...)
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *muxStream) fin() {
+	st.mu.Lock()
+	st.finRecv = true
+	st.mu.Unlock()
+	st.notify()
+}
+
+func (st *muxStream) update(read uint32) {
+	st.mu.Lock()
+	st.peerRead = read
+	st.mu.Unlock()
+	st.notify()
+}
+
+func deadlineTimer(v *atomic.Value) (<-chan time.Time, *time.Timer) {
+	d := v.Load().(time.Time)
+	if d.IsZero() {
+		return nil, nil
+	}
+	t := time.NewTimer(time.Until(d))
+	return t.C, t
+}
+
+func (st *muxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.buf) > 0 {
+			n := copy(b, st.buf)
+			st.buf = st.buf[n:]
+			if len(st.buf) == 0 {
+				st.buf = nil
+			}
+			st.consumed += uint32(n)
+			var update []byte
+			if st.consumed-st.acked >= muxStreamWindow/2 {
+				st.acked = st.consumed
+				update = make([]byte, 4)
+				binary.LittleEndian.PutUint32(update, st.acked)
+			}
+			st.mu.Unlock()
+			if update != nil {
+				st.sess.writeFrame(muxUPD, st.id, update)
+			}
+			return n, nil
+		}
+		finRecv, closed := st.finRecv, st.closed
+		st.mu.Unlock()
+		if closed {
+			return 0, errStreamClosed
+		}
+		if finRecv {
+			return 0, io.EOF
+		}
+		if st.sess.IsClosed() {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		timeout, timer := deadlineTimer(&st.readDeadline)
+		select {
+		case <-st.readEvent:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (st *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		st.mu.Lock()
+		closed, window := st.closed, muxStreamWindow-int(st.sent-st.peerRead)
+		st.mu.Unlock()
+		if closed {
+			return written, errStreamClosed
+		}
+		if st.sess.IsClosed() {
+			return written, st.sess.dieError
+		}
+		if window <= 0 {
+			timeout, timer := deadlineTimer(&st.writeDeadline)
+			select {
+			case <-st.writeEvent:
+			case <-timeout:
+				return written, os.ErrDeadlineExceeded
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+		n := len(b)
+		if n > window {
+			n = window
+		}
+		if n > muxMaxFrameSize {
+			n = muxMaxFrameSize
+		}
+		if err := st.sess.writeFrame(muxPSH, st.id, b[:n]); err != nil {
+			return written, err
+		}
+		st.mu.Lock()
+		st.sent += uint32(n)
+		st.mu.Unlock()
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.mu.Unlock()
+	st.notify()
+	st.sess.removeStream(st.id)
+	return st.sess.writeFrame(muxFIN, st.id, nil)
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.Store(t)
+	st.notify()
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.Store(t)
+	st.notify()
+	return nil
+}
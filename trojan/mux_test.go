@@ -0,0 +1,121 @@
+package trojan
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMuxDialConn(t *testing.T) {
+	s, cfg := newTestServer(t, "127.0.0.1:1")
+	s.SetMux(4, time.Second)
+	c := NewClient(s.tcpListener.Addr().String(), "trojan.test", Sha224(testPassword), 0, time.Second, cfg, context.Background(), nopLogger{})
+	c.SetMux(4, time.Second)
+	defer c.Close()
+
+	for i := 0; i < 6; i++ {
+		conn, err := c.DialConn("example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err = conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		in := acceptTestConn(t, s)
+		buf := make([]byte, 4)
+		if _, err = io.ReadFull(in, buf); err != nil || string(buf) != "ping" || in.Metadata().String() != "example.com:80" {
+			t.Fatalf("stream %d: got %q %v %v", i, buf, in.Metadata(), err)
+		}
+		in.Write([]byte("pong"))
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+			t.Fatalf("stream %d: client got %q %v", i, buf, err)
+		}
+	}
+	if len(c.sessions) != 2 {
+		t.Errorf("client has %d sessions, want 2", len(c.sessions))
+	}
+}
+
+func TestClientDialsOutsideLock(t *testing.T) {
+	// A listener that never handshakes keeps the dial waiting.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, maxStreams := range []int{0, 4} {
+		c := NewClient(l.Addr().String(), "trojan.test", Sha224(testPassword), 0, time.Second, nil, context.Background(), nopLogger{})
+		if maxStreams > 0 {
+			c.SetMux(maxStreams, time.Second)
+		}
+		done := make(chan struct{})
+		go func() {
+			c.DialConn("example.com:80")
+			close(done)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		if !c.muxMu.TryLock() {
+			t.Errorf("mux %d: lock held while dialing", maxStreams)
+		} else {
+			c.muxMu.Unlock()
+		}
+		c.Close()
+		<-done
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	a, b := net.Pipe()
+	client := newMuxSession(a, true, 1, time.Second)
+	server := newMuxSession(b, false, 1, time.Second)
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.OpenStream(); err != errMuxTooMany {
+		t.Errorf("second stream got %v, want %v", err, errMuxTooMany)
+	}
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 4*muxStreamWindow/16)
+	go func() {
+		st.Write(payload)
+		st.Close()
+	}()
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The writer is held back until the reader catches up.
+	time.Sleep(50 * time.Millisecond)
+	peer.mu.Lock()
+	buffered := len(peer.buf)
+	peer.mu.Unlock()
+	if buffered > muxStreamWindow {
+		t.Errorf("%d bytes buffered, window is %d", buffered, muxStreamWindow)
+	}
+	got, err := io.ReadAll(peer)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("got %d bytes %v, want %d", len(got), err, len(payload))
+	}
+}
+
+func TestMuxKeepAliveTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+	sess := newMuxSession(a, true, 1, 20*time.Millisecond)
+	select {
+	case <-sess.die:
+		if sess.dieError != errMuxKeepAlive {
+			t.Errorf("session closed with %v", sess.dieError)
+		}
+	case <-time.After(time.Second):
+		t.Error("silent session was not closed")
+	}
+}
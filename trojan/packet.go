@@ -31,16 +31,7 @@ func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 }
 
 func (c *PacketConn) WriteWithMetadata(b []byte, m *tunnel.Metadata) (int, error) {
-	packet := make([]byte, 0, MaxPacketSize)
-	w := bytes.NewBuffer(packet)
-	m.Address.WriteTo(w)
-	length := len(b)
-	buf := [2]byte{}
-	binary.BigEndian.PutUint16(buf[:], uint16(length))
-	w.Write(buf[:])
-	w.Write(CRLF)
-	w.Write(b)
-	_, err := c.Conn.Write(w.Bytes())
+	_, err := c.Conn.Write(MakeUDPacket(m.Address.Bytes(), b))
 	return len(b), err
 }
 
@@ -0,0 +1,76 @@
+package trojan
+
+import (
+	"github.com/koomox/goproxy/freedom"
+	"github.com/koomox/goproxy/tunnel"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SetUDPRelay makes the server relay UDP sessions itself with RelayPacket
+// instead of handing them to AcceptPacket. Zero turns it off.
+func (s *Server) SetUDPRelay(timeout time.Duration) {
+	s.Lock()
+	s.relayTimeout = timeout
+	s.Unlock()
+}
+
+// RelayPacket sends the datagrams of a trojan UDP session out of a socket
+// of its own and writes back replies from any remote, not only the ones
+// it sent to (full-cone NAT), tagged with their real source. It returns
+// once the session has carried nothing for timeout, and closes conn.
+func (s *Server) RelayPacket(conn tunnel.PacketConn, timeout time.Duration) error {
+	defer conn.Close()
+	out, err := freedom.DialPacket(timeout)
+	if err != nil {
+		s.log.Errorf("trojan udp relay error %v", err.Error())
+		return err
+	}
+	defer out.Close()
+
+	lastActive := time.Now().UnixNano()
+	touch := func() { atomic.StoreInt64(&lastActive, time.Now().UnixNano()) }
+	errChan := make(chan error, 2)
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, metadata, err := out.ReadWithMetadata(buf)
+			if err != nil {
+				// Datagrams going out keep the session alive too.
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() &&
+					time.Since(time.Unix(0, atomic.LoadInt64(&lastActive))) < timeout {
+					continue
+				}
+				errChan <- err
+				return
+			}
+			touch()
+			if _, err = conn.WriteWithMetadata(buf[:n], metadata); err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, metadata, err := conn.ReadWithMetadata(buf)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			touch()
+			if _, err = out.WriteWithMetadata(buf[:n], metadata); err != nil {
+				s.log.Errorf("trojan udp relay failed to send to %v %v", metadata, err.Error())
+			}
+		}
+	}()
+	select {
+	case err = <-errChan:
+		s.log.Debug("trojan udp relay closed", err)
+	case <-s.ctx.Done():
+		s.log.Debug("trojan udp relay closed")
+	}
+	return err
+}
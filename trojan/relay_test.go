@@ -0,0 +1,69 @@
+package trojan
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayPacketFullCone(t *testing.T) {
+	// The echo server answers from a second socket, which a port
+	// restricted NAT would drop.
+	in, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	reply, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := in.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			reply.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	s, cfg := newTestServer(t, "127.0.0.1:1")
+	s.SetUDPRelay(300 * time.Millisecond)
+	c := NewClient(s.tcpListener.Addr().String(), "trojan.test", Sha224(testPassword), 0, time.Second, cfg, context.Background(), nopLogger{})
+	defer c.Close()
+	pc, err := c.DialPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err = pc.WriteTo([]byte("query"), in.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, m, err := pc.ReadWithMetadata(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "query" || m.String() != reply.LocalAddr().String() {
+		t.Errorf("got %q from %v, want %q from %v", buf[:n], m, "query", reply.LocalAddr())
+	}
+
+	// The session expires once idle.
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := pc.ReadWithMetadata(buf)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Error("read after idle timeout succeeded")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("idle session was not closed")
+	}
+}
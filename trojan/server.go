@@ -1,6 +1,7 @@
 package trojan
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -10,6 +11,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 )
 
 type Hook interface {
@@ -21,8 +23,15 @@ type Hook interface {
 type Server struct {
 	sync.RWMutex
 	front         string
+	fallbacks     []*Fallback
+	websocket     *WebSocket
+	muxStreams    int
+	muxKeepAlive  time.Duration
+	relayTimeout  time.Duration
+	firstFlight   time.Duration
 	tcpListener   net.Listener
 	hook          Hook
+	users         *UserStore
 	authenticator bool
 	connChan      chan tunnel.Conn
 	packetChan    chan tunnel.PacketConn
@@ -42,6 +51,7 @@ func NewServer(front, addr string, tlsConfig *tls.Config, ctx context.Context, l
 		front:         front,
 		tcpListener:   tcpListener,
 		authenticator: false,
+		firstFlight:   firstFlightTimeout,
 		connChan:      make(chan tunnel.Conn, 32),
 		packetChan:    make(chan tunnel.PacketConn, 32),
 		ctx:           ctx,
@@ -58,6 +68,73 @@ func (s *Server) AddHook(hook Hook) {
 	s.authenticator = true
 }
 
+// AddUserStore authenticates clients against users instead of Hook.Auth and
+// accounts their traffic. Routing is still done by the hook, or every
+// connection is proxied when there is none.
+func (s *Server) AddUserStore(users *UserStore) {
+	s.users = users
+	s.authenticator = true
+}
+
+func (s *Server) auth(password string) (*User, bool) {
+	if s.users != nil {
+		return s.users.Auth(password)
+	}
+	return nil, s.hook.Auth(password)
+}
+
+func (s *Server) route(password string, metadata *tunnel.Metadata) byte {
+	if s.hook == nil {
+		return ActionProxy
+	}
+	return s.hook.Router(password, metadata)
+}
+
+// SetMux lets clients multiplex up to maxStreams streams over one
+// connection, and pings them every keepAlive. Streams are delivered by
+// AcceptConn and AcceptPacket like connections. Only clients of this
+// package speak this mux; trojan-go and other smux based clients do not.
+func (s *Server) SetMux(maxStreams int, keepAlive time.Duration) {
+	if maxStreams <= 0 {
+		maxStreams = DefaultMuxStreams
+	}
+	s.Lock()
+	s.muxStreams, s.muxKeepAlive = maxStreams, keepAlive
+	s.Unlock()
+}
+
+// SetFirstFlightTimeout sets how long a client may take after the TLS
+// handshake to send the trojan header, 2 seconds by default, before it is
+// handed to a fallback. A Client of this package keeps pooled connections
+// for half the default, so a shorter timeout cuts them off; clients that
+// handshake long before their first request need a longer one.
+func (s *Server) SetFirstFlightTimeout(timeout time.Duration) {
+	s.Lock()
+	s.firstFlight = timeout
+	s.Unlock()
+}
+
+func (s *Server) flightTimeout() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	return s.firstFlight
+}
+
+func (s *Server) serveMux(sess *muxSession) {
+	defer sess.Close()
+	for {
+		st, err := sess.AcceptStream()
+		if err != nil {
+			s.log.Debug("trojan mux session closed", err)
+			return
+		}
+		go func() {
+			st.SetReadDeadline(time.Now().Add(s.flightTimeout()))
+			s.serve(st, bufio.NewReader(st), false)
+		}()
+	}
+}
+
 func (s *Server) Close() error {
 	s.cancel()
 	return s.tcpListener.Close()
@@ -97,110 +174,139 @@ func (s *Server) acceptLoop() {
 			break
 		}
 
-		go func(c net.Conn) {
-			b := [56]byte{}
-			n, err := c.Read(b[:])
-			if err != nil {
-				c.Close()
-				s.log.Errorf("trojan read hash error %v", err.Error())
-				return
-			}
-			if !s.authenticator {
-				s.log.Errorf("authenticator is not load")
-				s.frontPage(c, b[:n])
-				return
-			}
-
-			if n != 56 {
-				s.log.Errorf("trojan failed to read hash %X", b[:n])
-				s.frontPage(c, b[:n])
-				return
-			}
-			password := string(b[:])
-			if !s.hook.Auth(password) {
-				s.log.Errorf("trojan invalid hash %v", password)
-				s.frontPage(c, b[:])
-				return
-			}
-
-			crlf := [2]byte{}
-			if _, err = io.ReadFull(c, crlf[:]); err != nil {
-				c.Close()
-				s.log.Errorf("trojan read CRLF error %v", err.Error())
-				return
-			}
-
-			metadata := &tunnel.Metadata{}
-			if err = metadata.ReadFrom(c); err != nil {
-				c.Close()
-				s.log.Errorf("trojan read address error %v", err.Error())
-				return
-			}
-			if _, err = io.ReadFull(c, crlf[:]); err != nil {
-				c.Close()
-				s.log.Errorf("trojan read CRLF error %v", err.Error())
-				return
-			}
+		go s.handleConn(c)
+	}
+}
 
-			switch s.hook.Router(password, metadata) {
-			case ActionAccept, ActionProxy:
-				switch metadata.Command {
-				case Connect:
-					s.connChan <- &InboundConn{Conn: c, hash: password, metadata: metadata}
-					s.log.Debug("trojan tcp connection")
-				case Associate:
-					s.packetChan <- &PacketConn{&InboundConn{Conn: c, hash: password, metadata: metadata}}
-					s.log.Debug("trojan udp connection")
-				default:
-					c.Close()
-					s.log.Errorf("unknown trojan command %v", metadata.Command)
-				}
-			case ActionDirect, ActionReject:
+func (s *Server) handleConn(c net.Conn) {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			c.Close()
+			s.log.Errorf("trojan tls handshake error %v", err.Error())
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+	c.SetReadDeadline(time.Now().Add(s.flightTimeout()))
+	r := bufio.NewReader(c)
+	s.RLock()
+	ws := s.websocket
+	s.RUnlock()
+	if ws != nil {
+		if req, n := s.peekUpgrade(r, ws); req != nil {
+			wc, err := s.acceptWebSocket(c, r, req, n, ws)
+			if err != nil {
 				c.Close()
+				s.log.Errorf("trojan websocket upgrade error %v", err.Error())
 				return
-			case ActionForward:
-				s.Forward(password, metadata, c)
 			}
-		}(c)
+			s.serve(wc, bufio.NewReader(wc), false)
+			return
+		}
 	}
+	s.serve(c, r, true)
 }
 
-func (s *Server) Forward(password string, metadata *tunnel.Metadata, c net.Conn) {
-	defer c.Close()
-	rc, err := s.hook.Forward(password, metadata)
+// serve reads the trojan header from r and hands the connection on. Once
+// a WebSocket is upgraded there is nothing left to give a fallback, so
+// front is false and bad clients are just closed.
+func (s *Server) serve(c net.Conn, r *bufio.Reader, front bool) {
+	reject := func() {
+		if front {
+			s.frontPage(c, r)
+		} else {
+			c.Close()
+		}
+	}
+	password, err := s.readHash(r)
 	if err != nil {
+		s.log.Errorf("trojan failed to read hash %v", err.Error())
+		reject()
 		return
 	}
-	defer rc.Close()
+	if !s.authenticator {
+		s.log.Errorf("authenticator is not load")
+		reject()
+		return
+	}
+	user, ok := s.auth(password)
+	if !ok {
+		s.log.Errorf("trojan invalid hash %v", password)
+		reject()
+		return
+	}
+	// The hash and its CRLF are authentic, drop them from the buffer.
+	r.Discard(hashLen + len(CRLF))
+	conn := &bufferedConn{Conn: c, r: r}
 
-	errChan := make(chan error, 2)
-	copyConn := func(left, right net.Conn) {
-		_, errInfo := io.Copy(left, right)
-		errChan <- errInfo
+	crlf := [2]byte{}
+	metadata := &tunnel.Metadata{}
+	if err = metadata.ReadFrom(conn); err != nil {
+		c.Close()
+		s.log.Errorf("trojan read address error %v", err.Error())
+		return
 	}
-	go copyConn(c, rc)
-	go copyConn(rc, c)
-	select {
-	case ch := <-errChan:
-		if ch != nil {
-			s.log.Errorf("trojan forward error %v", ch.Error())
+	if _, err = io.ReadFull(conn, crlf[:]); err != nil {
+		c.Close()
+		s.log.Errorf("trojan read CRLF error %v", err.Error())
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	if metadata.Command == Mux {
+		s.RLock()
+		maxStreams, keepAlive := s.muxStreams, s.muxKeepAlive
+		s.RUnlock()
+		if _, nested := c.(*muxStream); nested || maxStreams == 0 {
+			c.Close()
+			s.log.Errorf("trojan mux is not allowed")
+			return
 		}
-	case <-s.ctx.Done():
-		s.log.Debug("trojan forward closed")
+		s.log.Debug("trojan mux session")
+		s.serveMux(newMuxSession(conn, false, maxStreams, keepAlive))
+		return
+	}
+	inbound := &InboundConn{Conn: conn, hash: password, metadata: metadata, user: user}
+	if user != nil {
+		user.addConn(inbound)
+	}
+	switch s.route(password, metadata) {
+	case ActionAccept, ActionProxy:
+		switch metadata.Command {
+		case Connect:
+			s.connChan <- inbound
+			s.log.Debug("trojan tcp connection")
+		case Associate:
+			s.RLock()
+			relayTimeout := s.relayTimeout
+			s.RUnlock()
+			if relayTimeout > 0 {
+				s.log.Debug("trojan udp relay")
+				s.RelayPacket(&PacketConn{inbound}, relayTimeout)
+				return
+			}
+			s.packetChan <- &PacketConn{inbound}
+			s.log.Debug("trojan udp connection")
+		default:
+			inbound.Close()
+			s.log.Errorf("unknown trojan command %v", metadata.Command)
+		}
+	case ActionDirect, ActionReject:
+		inbound.Close()
 		return
+	case ActionForward:
+		s.Forward(password, metadata, inbound)
 	}
 }
 
-func (s *Server) frontPage(c net.Conn, b []byte) {
+func (s *Server) Forward(password string, metadata *tunnel.Metadata, c net.Conn) {
 	defer c.Close()
-	rc, err := net.Dial("tcp", s.front)
+	rc, err := s.hook.Forward(password, metadata)
 	if err != nil {
 		return
 	}
 	defer rc.Close()
-	if _, err = rc.Write(b); err != nil {
-		return
-	}
 
 	errChan := make(chan error, 2)
 	copyConn := func(left, right net.Conn) {
@@ -212,10 +318,10 @@ func (s *Server) frontPage(c net.Conn, b []byte) {
 	select {
 	case ch := <-errChan:
 		if ch != nil {
-			s.log.Errorf("trojan relay error %v", ch.Error())
+			s.log.Errorf("trojan forward error %v", ch.Error())
 		}
 	case <-s.ctx.Done():
-		s.log.Debug("trojan server closed")
+		s.log.Debug("trojan forward closed")
 		return
 	}
 }
@@ -0,0 +1,79 @@
+package trojan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/koomox/goproxy/tunnel"
+	"io"
+	"net"
+)
+
+var (
+	errInvalidAddrType = errors.New("trojan udp packet has invalid ATYP")
+	errInvalidCRLF     = errors.New("trojan udp packet has invalid CRLF")
+)
+
+// MakeUDPacket frames a payload as a trojan UDP packet:
+// ATYP | DST.ADDR | DST.PORT | Length | CRLF | Payload
+func MakeUDPacket(addr, payload []byte) []byte {
+	b := make([]byte, 0, len(addr)+4+len(payload))
+	b = append(b, addr...)
+	b = append(b, byte(len(payload)>>8), byte(len(payload)))
+	b = append(b, CRLF...)
+	return append(b, payload...)
+}
+
+// ReadUDPacket parses one trojan UDP packet from the beginning of buffer.
+// When buffer holds only part of a packet, the rest is read from r.
+// buffered holds the bytes following the packet, if any, and should be
+// passed back as buffer on the next call.
+func ReadUDPacket(buffer []byte, r io.Reader) (addr, payload, buffered []byte, err error) {
+	fill := func(n int) error {
+		if len(buffer) >= n {
+			return nil
+		}
+		if r == nil {
+			return io.ErrUnexpectedEOF
+		}
+		b := make([]byte, n)
+		m := copy(b, buffer)
+		if _, err := io.ReadFull(r, b[m:]); err != nil {
+			return err
+		}
+		buffer = b
+		return nil
+	}
+
+	if err = fill(1); err != nil {
+		return
+	}
+	addrLen := 1
+	switch buffer[0] {
+	case tunnel.DomainName:
+		if err = fill(2); err != nil {
+			return
+		}
+		addrLen += 1 + int(buffer[1]) + 2
+	case tunnel.IPv4:
+		addrLen += net.IPv4len + 2
+	case tunnel.IPv6:
+		addrLen += net.IPv6len + 2
+	default:
+		return nil, nil, nil, errInvalidAddrType
+	}
+	if err = fill(addrLen + 4); err != nil {
+		return
+	}
+	if !bytes.Equal(buffer[addrLen+2:addrLen+4], CRLF) {
+		return nil, nil, nil, errInvalidCRLF
+	}
+	end := addrLen + 4 + int(binary.BigEndian.Uint16(buffer[addrLen:addrLen+2]))
+	if err = fill(end); err != nil {
+		return
+	}
+	if len(buffer) > end {
+		buffered = buffer[end:]
+	}
+	return buffer[:addrLen], buffer[addrLen+4 : end], buffered, nil
+}
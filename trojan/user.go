@@ -0,0 +1,262 @@
+package trojan
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// User is an account in a UserStore, identified by its password hash.
+type User struct {
+	// Traffic counters come first to keep them 64-bit aligned for atomic
+	// access. upload and download count the current month only.
+	upload        uint64
+	download      uint64
+	totalUpload   uint64
+	totalDownload uint64
+	month         int64
+	quota         uint64
+
+	sync.Mutex
+	hash      string
+	store     *UserStore
+	upLimit   *rateLimiter
+	downLimit *rateLimiter
+	conns     map[*InboundConn]struct{}
+}
+
+func (u *User) Hash() string {
+	return u.hash
+}
+
+// Upload returns the bytes received from the user this month.
+func (u *User) Upload() uint64 {
+	u.rollMonth()
+	return atomic.LoadUint64(&u.upload)
+}
+
+// Download returns the bytes sent to the user this month.
+func (u *User) Download() uint64 {
+	u.rollMonth()
+	return atomic.LoadUint64(&u.download)
+}
+
+// Total returns the bytes transferred since the user was added.
+func (u *User) Total() (upload, download uint64) {
+	return atomic.LoadUint64(&u.totalUpload), atomic.LoadUint64(&u.totalDownload)
+}
+
+// Quota returns the monthly traffic quota in bytes, zero for unlimited.
+func (u *User) Quota() uint64 {
+	return atomic.LoadUint64(&u.quota)
+}
+
+func (u *User) SetQuota(quota uint64) {
+	atomic.StoreUint64(&u.quota, quota)
+}
+
+// SpeedLimit returns the per-direction limit in bytes per second, zero for
+// unlimited.
+func (u *User) SpeedLimit() int {
+	return u.upLimit.Rate()
+}
+
+func (u *User) SetSpeedLimit(limit int) {
+	u.upLimit.SetRate(limit)
+	u.downLimit.SetRate(limit)
+}
+
+// Exceeded reports whether the user has used up the monthly quota.
+func (u *User) Exceeded() bool {
+	quota := u.Quota()
+	return quota > 0 && u.Upload()+u.Download() >= quota
+}
+
+// Conns returns the number of live connections of the user.
+func (u *User) Conns() int {
+	u.Lock()
+	defer u.Unlock()
+	return len(u.conns)
+}
+
+// Kick closes all live connections of the user.
+func (u *User) Kick() {
+	u.Lock()
+	conns := make([]*InboundConn, 0, len(u.conns))
+	for c := range u.conns {
+		conns = append(conns, c)
+	}
+	u.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (u *User) addConn(c *InboundConn) {
+	u.Lock()
+	u.conns[c] = struct{}{}
+	u.Unlock()
+}
+
+func (u *User) delConn(c *InboundConn) {
+	u.Lock()
+	delete(u.conns, c)
+	u.Unlock()
+}
+
+func (u *User) addUpload(n int) {
+	u.rollMonth()
+	atomic.AddUint64(&u.upload, uint64(n))
+	atomic.AddUint64(&u.totalUpload, uint64(n))
+	u.upLimit.Wait(n)
+	u.checkQuota()
+}
+
+func (u *User) addDownload(n int) {
+	u.rollMonth()
+	atomic.AddUint64(&u.download, uint64(n))
+	atomic.AddUint64(&u.totalDownload, uint64(n))
+	u.downLimit.Wait(n)
+	u.checkQuota()
+}
+
+func (u *User) checkQuota() {
+	if u.store.kick && u.Exceeded() {
+		u.Kick()
+	}
+}
+
+// rollMonth resets the monthly counters when a new month starts.
+func (u *User) rollMonth() {
+	now := time.Now()
+	month := int64(now.Year())*12 + int64(now.Month())
+	if last := atomic.LoadInt64(&u.month); last != month && atomic.CompareAndSwapInt64(&u.month, last, month) {
+		atomic.StoreUint64(&u.upload, 0)
+		atomic.StoreUint64(&u.download, 0)
+	}
+}
+
+// UserStore is a runtime-editable set of trojan users. Add it to a Server
+// with AddUserStore to authenticate and account connections.
+type UserStore struct {
+	sync.RWMutex
+	users map[string]*User
+	kick  bool
+}
+
+// NewUserStore creates an empty store. With kick set, live connections of
+// a user are closed when the user is removed or exceeds the quota.
+func NewUserStore(kick bool) *UserStore {
+	return &UserStore{users: make(map[string]*User), kick: kick}
+}
+
+// AddUser adds a user by password hash, or updates the quota and speed
+// limit of an existing one while keeping its traffic counters.
+func (s *UserStore) AddUser(hash string, quota uint64, speedLimit int) *User {
+	s.Lock()
+	defer s.Unlock()
+	if u, ok := s.users[hash]; ok {
+		u.SetQuota(quota)
+		u.SetSpeedLimit(speedLimit)
+		return u
+	}
+	u := &User{
+		quota:     quota,
+		hash:      hash,
+		store:     s,
+		upLimit:   newRateLimiter(speedLimit),
+		downLimit: newRateLimiter(speedLimit),
+		conns:     make(map[*InboundConn]struct{}),
+	}
+	u.rollMonth()
+	s.users[hash] = u
+	return u
+}
+
+// RemoveUser removes a user and reports whether it existed.
+func (s *UserStore) RemoveUser(hash string) bool {
+	s.Lock()
+	u, ok := s.users[hash]
+	delete(s.users, hash)
+	s.Unlock()
+	if ok && s.kick {
+		u.Kick()
+	}
+	return ok
+}
+
+func (s *UserStore) GetUser(hash string) (*User, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	u, ok := s.users[hash]
+	return u, ok
+}
+
+func (s *UserStore) ListUsers() []*User {
+	s.RLock()
+	defer s.RUnlock()
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	return users
+}
+
+// Auth returns the user for hash if it exists and has quota left.
+func (s *UserStore) Auth(hash string) (*User, bool) {
+	u, ok := s.GetUser(hash)
+	if !ok || u.Exceeded() {
+		return nil, false
+	}
+	return u, true
+}
+
+// rateLimiter is a token bucket holding up to one second of traffic.
+type rateLimiter struct {
+	sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+func (l *rateLimiter) Rate() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.rate
+}
+
+func (l *rateLimiter) SetRate(rate int) {
+	l.Lock()
+	l.rate = rate
+	l.tokens = float64(rate)
+	l.last = time.Now()
+	l.Unlock()
+}
+
+// Wait blocks until n bytes fit into the rate.
+func (l *rateLimiter) Wait(n int) {
+	l.Lock()
+	if l.rate <= 0 {
+		l.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
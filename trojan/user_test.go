@@ -0,0 +1,109 @@
+package trojan
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestUserStore(t *testing.T) {
+	store := NewUserStore(false)
+	u := store.AddUser("a", 100, 0)
+	store.AddUser("b", 0, 0)
+	if got := store.AddUser("a", 200, 1024); got != u || u.Quota() != 200 || u.SpeedLimit() != 1024 {
+		t.Errorf("re-adding did not update the existing user")
+	}
+	if n := len(store.ListUsers()); n != 2 {
+		t.Errorf("got %d users, want 2", n)
+	}
+
+	tests := []struct {
+		name     string
+		hash     string
+		upload   int
+		download int
+		ok       bool
+	}{
+		{"unknown", "c", 0, 0, false},
+		{"unlimited", "b", 1 << 20, 1 << 20, true},
+		{"within quota", "a", 100, 50, true},
+		{"quota exceeded", "a", 30, 20, false},
+	}
+	for _, tt := range tests {
+		if u, ok := store.GetUser(tt.hash); ok {
+			u.addUpload(tt.upload)
+			u.addDownload(tt.download)
+		}
+		if _, ok := store.Auth(tt.hash); ok != tt.ok {
+			t.Errorf("%s: got auth %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+	if up, down := u.Total(); up != 130 || down != 70 {
+		t.Errorf("got totals %d/%d, want 130/70", up, down)
+	}
+	if !store.RemoveUser("a") || store.RemoveUser("a") {
+		t.Error("RemoveUser did not report existence")
+	}
+}
+
+func TestUserStoreAccounting(t *testing.T) {
+	tests := []struct {
+		name   string
+		quota  uint64
+		remove bool
+		kicked bool
+	}{
+		{"accounted", 0, false, false},
+		{"quota exceeded", 10, false, true},
+		{"removed", 0, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, cfg := newTestServer(t, "127.0.0.1:1")
+			hash := string(Sha224(testPassword))
+			store := NewUserStore(true)
+			user := store.AddUser(hash, tt.quota, 0)
+			s.AddUserStore(store)
+			c := NewClient(s.tcpListener.Addr().String(), "trojan.test", Sha224(testPassword), 0, time.Second, cfg, context.Background(), nopLogger{})
+			defer c.Close()
+
+			conn, err := c.DialConn("example.com:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("ping"))
+			in := acceptTestConn(t, s)
+			io.ReadFull(in, make([]byte, 4))
+			in.Write([]byte("pong"))
+			io.ReadFull(conn, make([]byte, 4))
+			if user.Upload() != 4 || user.Download() != 4 || user.Conns() != 1 {
+				t.Fatalf("got upload %d download %d conns %d", user.Upload(), user.Download(), user.Conns())
+			}
+
+			if tt.remove {
+				store.RemoveUser(hash)
+			} else {
+				in.Write([]byte("more"))
+			}
+			in.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err = in.Read(make([]byte, 1))
+			if kicked := err != nil && user.Conns() == 0; kicked != tt.kicked {
+				t.Errorf("got kicked %v (%v), want %v", kicked, err, tt.kicked)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(10000)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		l.Wait(5000)
+	}
+	// 5000 bytes beyond the one second burst take half a second.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Errorf("took %v, want about 500ms", elapsed)
+	}
+}
@@ -0,0 +1,411 @@
+package trojan
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xA
+
+	wsMaxControlLen = 125
+)
+
+var (
+	errWebSocketMask      = errors.New("websocket frame masking is wrong for its direction")
+	errWebSocketControl   = errors.New("websocket control frame is fragmented or too long")
+	errWebSocketLength    = errors.New("websocket frame length is invalid")
+	errWebSocketHandshake = errors.New("websocket handshake failed")
+)
+
+// WebSocket carries trojan in binary WebSocket frames (RFC 6455), for
+// servers behind CDNs that only pass HTTP. Path defaults to "/". Host is
+// the Host header sent by the client and, when set on the server, the
+// only one it accepts. EarlyData is the most bytes of the first write the
+// client puts in the Sec-WebSocket-Protocol header, and the most the
+// server takes from it; zero disables early data.
+type WebSocket struct {
+	Path      string
+	Host      string
+	EarlyData int
+}
+
+func (ws *WebSocket) path() string {
+	if ws.Path == "" {
+		return "/"
+	}
+	return ws.Path
+}
+
+// AddWebSocket makes the server accept trojan over WebSocket upgrades to
+// ws.Path besides raw TLS. Other HTTP requests still go to the fallbacks.
+func (s *Server) AddWebSocket(ws *WebSocket) {
+	s.Lock()
+	s.websocket = ws
+	s.Unlock()
+}
+
+// AddWebSocket makes the client carry trojan over WebSocket. An empty
+// ws.Host defaults to the TLS server name.
+func (c *Client) AddWebSocket(ws *WebSocket) {
+	cfg := *ws
+	if cfg.Host == "" {
+		cfg.Host = c.tlsConfig.ServerName
+	}
+	c.websocket = &cfg
+}
+
+// WebSocketClient returns a client WebSocket connection over conn. The
+// upgrade request goes out with the first write, carrying up to
+// ws.EarlyData bytes of it, and the response is read with the first read.
+func WebSocketClient(conn net.Conn, ws *WebSocket) net.Conn {
+	return &wsConn{Conn: conn, r: bufio.NewReader(conn), client: true, ws: ws}
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// peekUpgrade returns the request at the start of r if it is a WebSocket
+// upgrade to the configured path, and its length. Nothing is consumed, so
+// any other first flight is still there for readHash or a fallback.
+func (s *Server) peekUpgrade(r *bufio.Reader, ws *WebSocket) (*http.Request, int) {
+	if b, err := r.Peek(1); err != nil || b[0] != 'G' {
+		return nil, 0
+	}
+	var n int
+	for {
+		b, err := r.Peek(r.Buffered())
+		if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+			n = i + 4
+			break
+		}
+		if err != nil || len(b) >= r.Size() {
+			return nil, 0
+		}
+		if _, err = r.Peek(len(b) + 1); err != nil {
+			return nil, 0
+		}
+	}
+	b, _ := r.Peek(n)
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, 0
+	}
+	if req.Method != http.MethodGet || req.URL.Path != ws.path() ||
+		!headerContains(req.Header, "Connection", "upgrade") ||
+		!headerContains(req.Header, "Upgrade", "websocket") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" ||
+		req.Header.Get("Sec-WebSocket-Key") == "" {
+		return nil, 0
+	}
+	if ws.Host != "" && !strings.EqualFold(req.Host, ws.Host) {
+		return nil, 0
+	}
+	return req, n
+}
+
+// acceptWebSocket consumes the upgrade request from r and answers it. Early
+// data in Sec-WebSocket-Protocol is read back before the first frame.
+func (s *Server) acceptWebSocket(c net.Conn, r *bufio.Reader, req *http.Request, n int, ws *WebSocket) (net.Conn, error) {
+	r.Discard(n)
+	var early []byte
+	protocol := req.Header.Get("Sec-WebSocket-Protocol")
+	if protocol != "" && ws.EarlyData > 0 {
+		b, err := base64.RawURLEncoding.DecodeString(protocol)
+		if err != nil || len(b) > ws.EarlyData {
+			protocol = ""
+		} else {
+			early = b
+		}
+	} else {
+		protocol = ""
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 256))
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	buf.WriteString("Sec-WebSocket-Accept: " + wsAcceptKey(req.Header.Get("Sec-WebSocket-Key")) + "\r\n")
+	if protocol != "" {
+		buf.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return &wsConn{Conn: c, r: r, early: early}, nil
+}
+
+// wsConn is a WebSocket connection whose binary payload is a byte stream.
+// Frames sent by the client are masked, as RFC 6455 requires.
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool
+	early  []byte
+
+	rmu       sync.Mutex
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	closed    bool
+
+	wmu       sync.Mutex
+	ws        *WebSocket
+	key       string
+	requested bool
+	sentClose bool
+
+	responseOnce sync.Once
+	responseErr  error
+}
+
+// request writes the client upgrade request with early data. wmu is held.
+func (c *wsConn) request(early []byte) error {
+	c.requested = true
+	key := make([]byte, 16)
+	rand.Read(key)
+	c.key = base64.StdEncoding.EncodeToString(key)
+	buf := bytes.NewBuffer(make([]byte, 0, 512))
+	fmt.Fprintf(buf, "GET %v HTTP/1.1\r\nHost: %v\r\n", c.ws.path(), c.ws.Host)
+	buf.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n")
+	buf.WriteString("Sec-WebSocket-Key: " + c.key + "\r\n")
+	if len(early) > 0 {
+		buf.WriteString("Sec-WebSocket-Protocol: " + base64.RawURLEncoding.EncodeToString(early) + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	_, err := c.Conn.Write(buf.Bytes())
+	return err
+}
+
+func (c *wsConn) readResponse() error {
+	c.wmu.Lock()
+	if !c.requested {
+		if err := c.request(nil); err != nil {
+			c.wmu.Unlock()
+			return err
+		}
+	}
+	key := c.key
+	c.wmu.Unlock()
+
+	resp, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		return fmt.Errorf("websocket read response error %v", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return errWebSocketHandshake
+	}
+	return nil
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	if c.client {
+		c.responseOnce.Do(func() { c.responseErr = c.readResponse() })
+		if c.responseErr != nil {
+			return 0, c.responseErr
+		}
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.early) > 0 {
+		n := copy(b, c.early)
+		c.early = c.early[n:]
+		return n, nil
+	}
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+func (c *wsConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// nextFrame reads a frame header, answering control frames on the way.
+func (c *wsConn) nextFrame() error {
+	h := [2]byte{}
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return err
+	}
+	fin, op := h[0]&0x80 != 0, h[0]&0x0F
+	masked, length := h[1]&0x80 != 0, uint64(h[1]&0x7F)
+	if masked == c.client {
+		return errWebSocketMask
+	}
+	switch length {
+	case 126:
+		b := [2]byte{}
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		b := [8]byte{}
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return err
+		}
+		if length = binary.BigEndian.Uint64(b[:]); length>>63 != 0 {
+			return errWebSocketLength
+		}
+	}
+	c.masked, c.maskPos = masked, 0
+	if masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		c.remaining = length
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if !fin || length > wsMaxControlLen {
+			return errWebSocketControl
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch op {
+		case wsOpClose:
+			c.closed = true
+			c.writeClose()
+		case wsOpPing:
+			c.wmu.Lock()
+			err := c.writeFrame(wsOpPong, payload)
+			c.wmu.Unlock()
+			return err
+		}
+		return nil
+	default:
+		return fmt.Errorf("websocket unknown opcode %v", op)
+	}
+}
+
+// writeFrame writes one final frame. wmu is held.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	buf := bytes.NewBuffer(make([]byte, 0, len(payload)+14))
+	buf.WriteByte(0x80 | op)
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= wsMaxControlLen:
+		buf.WriteByte(maskBit | byte(n))
+	case n <= 0xFFFF:
+		buf.WriteByte(maskBit | 126)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(maskBit | 127)
+		binary.Write(buf, binary.BigEndian, uint64(n))
+	}
+	if !c.client {
+		buf.Write(payload)
+		_, err := c.Conn.Write(buf.Bytes())
+		return err
+	}
+	mask := [4]byte{}
+	rand.Read(mask[:])
+	buf.Write(mask[:])
+	for i, b := range payload {
+		buf.WriteByte(b ^ mask[i&3])
+	}
+	_, err := c.Conn.Write(buf.Bytes())
+	return err
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.sentClose {
+		return 0, net.ErrClosed
+	}
+	b := p
+	if c.client && !c.requested {
+		n := len(b)
+		if n > c.ws.EarlyData {
+			n = c.ws.EarlyData
+		}
+		if err := c.request(b[:n]); err != nil {
+			return 0, err
+		}
+		if b = b[n:]; len(b) == 0 {
+			return len(p), nil
+		}
+	}
+	if err := c.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeClose sends a normal closure frame once.
+func (c *wsConn) writeClose() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.sentClose || c.client && !c.requested {
+		return
+	}
+	c.sentClose = true
+	c.writeFrame(wsOpClose, []byte{0x03, 0xE8})
+}
+
+func (c *wsConn) Close() error {
+	c.writeClose()
+	return c.Conn.Close()
+}
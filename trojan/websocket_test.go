@@ -0,0 +1,109 @@
+package trojan
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWebSocketDialConn(t *testing.T) {
+	for _, early := range []int{0, 16, 2048} {
+		s, cfg := newTestServer(t, "127.0.0.1:1")
+		s.AddWebSocket(&WebSocket{Path: "/ws", EarlyData: 2048})
+		c := NewClient(s.tcpListener.Addr().String(), "trojan.test", Sha224(testPassword), 0, time.Second, cfg, context.Background(), nopLogger{})
+		c.AddWebSocket(&WebSocket{Path: "/ws", EarlyData: early})
+
+		conn, err := c.DialConn("example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		in := acceptTestConn(t, s)
+		if in.Metadata().String() != "example.com:80" {
+			t.Errorf("early %v: got metadata %v", early, in.Metadata())
+		}
+		buf := make([]byte, 4)
+		if _, err = io.ReadFull(in, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("early %v: server got %q %v", early, buf, err)
+		}
+		in.Write([]byte("pong"))
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+			t.Errorf("early %v: client got %q %v", early, buf, err)
+		}
+		conn.Close()
+		c.Close()
+	}
+}
+
+func TestWebSocketOtherPathFallback(t *testing.T) {
+	front, frontCh := fallbackListener(t)
+	s, cfg := newTestServer(t, front)
+	s.AddWebSocket(&WebSocket{Path: "/ws"})
+	cfg.ServerName = "trojan.test"
+	conn, err := tls.Dial("tcp", s.tcpListener.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	flight := []byte("GET /other HTTP/1.1\r\nHost: trojan.test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	conn.Write(flight)
+	expectFallback(t, frontCh, flight)
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	client := &wsConn{Conn: a, r: bufio.NewReader(a), client: true, ws: &WebSocket{}, requested: true}
+	server := &wsConn{Conn: b, r: bufio.NewReader(b)}
+	client.responseOnce.Do(func() {})
+
+	payload := make([]byte, 70000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	go func() {
+		client.wmu.Lock()
+		client.writeFrame(wsOpPing, []byte("hi"))
+		client.wmu.Unlock()
+		client.Write(payload)
+	}()
+	got := make([]byte, len(payload))
+	if _, err = io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if got[i] != payload[i] {
+			t.Fatalf("byte %d is %d, want %d", i, got[i], payload[i])
+		}
+	}
+
+	// The pong to the ping above is read ahead of the close reply.
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		done <- err
+	}()
+	server.Close()
+	if err := <-done; err != io.EOF {
+		t.Errorf("client read after close got %v, want EOF", err)
+	}
+}
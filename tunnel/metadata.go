@@ -15,6 +15,12 @@ const (
 	IPv6       byte = 0x04
 )
 
+const (
+	Connect   byte = 0x01
+	Bind      byte = 0x02
+	Associate byte = 0x03
+)
+
 type Address struct {
 	DomainName  string
 	Port        int
@@ -26,6 +32,38 @@ type Address struct {
 type Metadata struct {
 	Command byte
 	*Address
+	HTTP *HTTPRequest
+}
+
+// HTTPRequest holds the attributes of the HTTP proxy request a connection
+// arrived with. It is not carried over the wire.
+type HTTPRequest struct {
+	UserAgent string
+	Host      string
+	Method    string
+	Path      string
+}
+
+// FakeIP reverses the addresses handed out by a fake-IP DNS to the
+// domains they stand for. dns.FakeIPPool satisfies it.
+type FakeIP interface {
+	LookupIP(ip net.IP) (string, bool)
+}
+
+// ReverseFakeIP replaces a fake IP destination of f by the domain it was
+// handed out for, keeping the port, so that rules match and dialing resolve
+// the real host. It reports whether the address was replaced; a nil f
+// replaces nothing.
+func (r *Metadata) ReverseFakeIP(f FakeIP) bool {
+	if f == nil || r.Address == nil || (r.AddressType != IPv4 && r.AddressType != IPv6) {
+		return false
+	}
+	host, ok := f.LookupIP(r.IP)
+	if !ok {
+		return false
+	}
+	r.Address = &Address{DomainName: host, Port: r.Address.Port, NetworkType: r.Address.NetworkType, AddressType: DomainName}
+	return true
 }
 
 func (r *Metadata) ReadFrom(reader io.Reader) (err error) {
@@ -72,6 +110,34 @@ func (r *Metadata) String() string {
 	return r.Address.String()
 }
 
+func (r *Metadata) UserAgent() string {
+	if r.HTTP == nil {
+		return ""
+	}
+	return r.HTTP.UserAgent
+}
+
+func (r *Metadata) HTTPHost() string {
+	if r.HTTP == nil {
+		return ""
+	}
+	return r.HTTP.Host
+}
+
+func (r *Metadata) HTTPMethod() string {
+	if r.HTTP == nil {
+		return ""
+	}
+	return r.HTTP.Method
+}
+
+func (r *Metadata) HTTPPath() string {
+	if r.HTTP == nil {
+		return ""
+	}
+	return r.HTTP.Path
+}
+
 func (a *Address) Host() string {
 	switch a.AddressType {
 	case IPv4, IPv6: